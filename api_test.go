@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Handlers log every call, which drowns out test failures. Password hashing
+// at full cost would make the concurrent tests crawl under -race.
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	passwordCost = bcrypt.MinCost
+	os.Exit(m.Run())
+}
+
+type testAPI struct {
+	t      *testing.T
+	cfg    *apiConfig
+	server *httptest.Server
+}
+
+func newTestAPI(t *testing.T, store Store) *testAPI {
+	t.Helper()
+	keys, err := newKeyring(store, t.TempDir(), "test-secret", "HS256", "chirpy", "chirpy-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &apiConfig{
+		keys:     keys,
+		MediaDir: t.TempDir(),
+		MediaURL: "/app/media",
+		database: store,
+	}
+	server := httptest.NewServer(cfg.routes())
+	t.Cleanup(server.Close)
+	return &testAPI{t: t, cfg: cfg, server: server}
+}
+
+// Sends body as JSON, decodes the response into out if it's not nil and
+// returns the status. Safe to call from several goroutines.
+func (api *testAPI) do(method, path, token string, body, out interface{}) int {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			api.t.Errorf("Marshal %s %s: %s", method, path, err)
+			return 0
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, api.server.URL+path, reader)
+	if err != nil {
+		api.t.Errorf("%s %s: %s", method, path, err)
+		return 0
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		api.t.Errorf("%s %s: %s", method, path, err)
+		return 0
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode < 300 {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			api.t.Errorf("Decode %s %s: %s", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+type testLogin struct {
+	ID           int    `json:"id"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	SessionID    string `json:"session_id"`
+}
+
+func (api *testAPI) signUp(email string) testLogin {
+	creds := jsonBody{Email: email, Password: "hunter2"}
+	status := api.do("POST", "/api/users", "", creds, nil)
+	if status != http.StatusCreated {
+		api.t.Errorf("Creating %s got %d", email, status)
+	}
+	return api.login(email)
+}
+
+func (api *testAPI) login(email string) testLogin {
+	login := testLogin{}
+	status := api.do("POST", "/api/login", "", jsonBody{Email: email, Password: "hunter2"}, &login)
+	if status != http.StatusOK {
+		api.t.Errorf("Logging in %s got %d", email, status)
+	}
+	return login
+}
+
+// Both stores, the JSON one writes through its WAL on every change
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	db, err := newStore("json", t.TempDir()+"/database.json", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{"memory": NewMemoryDB(), "json": db}
+}
+
+// Lots of users signing up, logging in, posting and deleting at once while
+// others read. Run with -race to catch unsynchronised access.
+func TestConcurrentAPI(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testConcurrentAPI(t, store)
+		})
+	}
+}
+
+func testConcurrentAPI(t *testing.T, store Store) {
+	api := newTestAPI(t, store)
+	const users = 16
+	const chirpsEach = 10
+
+	var mu sync.Mutex
+	kept := map[int]int{}
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			email := fmt.Sprintf("user%d@example.com", i)
+			login := api.signUp(email)
+			for j := 0; j < chirpsEach; j++ {
+				chirp := chirpsResponse{}
+				status := api.do("POST", "/api/chirps", login.Token, jsonBody{Body: fmt.Sprintf("chirp %d from %d", j, i)}, &chirp)
+				if status != http.StatusCreated {
+					t.Errorf("Creating chirp got %d", status)
+					continue
+				}
+				if j%2 == 0 {
+					status = api.do("DELETE", fmt.Sprintf("/api/chirps/%d", chirp.ID), login.Token, nil, nil)
+					if status != http.StatusNoContent {
+						t.Errorf("Deleting chirp %d got %d", chirp.ID, status)
+					}
+					continue
+				}
+				mu.Lock()
+				kept[chirp.ID] = login.ID
+				mu.Unlock()
+			}
+			// Logging in again while everyone else is writing
+			api.login(email)
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				chirps := []chirpsResponse{}
+				status := api.do("GET", "/api/chirps?limit=50", "", nil, &chirps)
+				if status != http.StatusOK {
+					t.Errorf("Listing chirps got %d", status)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(kept) != users*chirpsEach/2 {
+		t.Fatalf("Expected %d chirps kept, got %d", users*chirpsEach/2, len(kept))
+	}
+	all, err := api.cfg.database.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(kept) {
+		t.Errorf("Store has %d chirps, expected %d", len(all), len(kept))
+	}
+	for id, author := range kept {
+		chirp, ok := all[id]
+		if !ok {
+			t.Errorf("Chirp %d is missing", id)
+			continue
+		}
+		if chirp.Author != author {
+			t.Errorf("Chirp %d has author %d, expected %d", id, chirp.Author, author)
+		}
+	}
+}
+
+// The same email signing up from many requests at once gets one account
+func TestConcurrentSignUpSameEmail(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	var created, conflicts int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status := api.do("POST", "/api/users", "", jsonBody{Email: "same@example.com", Password: "hunter2"}, nil)
+			mu.Lock()
+			defer mu.Unlock()
+			switch status {
+			case http.StatusCreated:
+				created++
+			case http.StatusConflict:
+				conflicts++
+			default:
+				t.Errorf("Unexpected status %d", status)
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 1 || conflicts != 19 {
+		t.Errorf("Expected 1 created and 19 conflicts, got %d and %d", created, conflicts)
+	}
+}
+
+// /app serves the front end and uploads, never the files around them like
+// the database or the source
+func TestAppServesOnlyPublicFiles(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	err := os.WriteFile(api.cfg.MediaDir+"/upload.png", []byte("png"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]int{
+		"/app":                  http.StatusOK,
+		"/app/":                 http.StatusOK,
+		"/app/assets/logo.png":  http.StatusOK,
+		"/app/media/upload.png": http.StatusOK,
+		"/app/database.json":    http.StatusNotFound,
+		"/app/go.mod":           http.StatusNotFound,
+		"/app/main.go":          http.StatusNotFound,
+		"/app/assets/":          http.StatusNotFound,
+		"/app/media/":           http.StatusNotFound,
+		"/app/media/../go.mod":  http.StatusNotFound,
+	}
+	for path, want := range cases {
+		resp, err := http.Get(api.server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("GET %s: expected %d, got %d", path, want, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Moves a deleted chirp's deletion back by age, as if it happened then
+func backdateDeletion(m *MemoryDB, chirpID int, age time.Duration) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	chirp := m.chirps.Chirps[chirpID]
+	deletedAt := time.Now().UTC().Add(-age)
+	chirp.DeletedAt = &deletedAt
+	m.chirps.Chirps[chirpID] = chirp
+}
+
+func TestSoftDeleteAndRestore(t *testing.T) {
+	db := NewMemoryDB()
+	chirp := mustCreateChirp(t, db, 1, "hello")
+
+	err := db.DeleteChirp(chirp.ID, 2)
+	if !errors.Is(err, errNotAuthor) {
+		t.Fatalf("Expected errNotAuthor deleting someone else's chirp, got %v", err)
+	}
+	err = db.DeleteChirp(chirp.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.GetChirpByID(chirp.ID)
+	if !errors.Is(err, errChirpNotFound) {
+		t.Errorf("Expected a deleted chirp to be hidden, got %v", err)
+	}
+	chirps, _ := db.GetChirps()
+	if _, ok := chirps[chirp.ID]; ok {
+		t.Error("Expected a deleted chirp to be left out of GetChirps")
+	}
+
+	_, err = db.RestoreChirp(chirp.ID, 2)
+	if !errors.Is(err, errNotAuthor) {
+		t.Errorf("Expected errNotAuthor restoring someone else's chirp, got %v", err)
+	}
+	restored, err := db.RestoreChirp(chirp.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Body != "hello" || restored.DeletedAt != nil {
+		t.Errorf("Expected the chirp back as it was, got %+v", restored)
+	}
+	if _, err := db.GetChirpByID(chirp.ID); err != nil {
+		t.Errorf("Expected a restored chirp to be visible, got %v", err)
+	}
+}
+
+func TestRestoreAfterRetention(t *testing.T) {
+	db := NewMemoryDB()
+	chirp := mustCreateChirp(t, db, 1, "hello")
+	err := db.DeleteChirp(chirp.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backdateDeletion(db, chirp.ID, chirpRetention+time.Hour)
+	_, err = db.RestoreChirp(chirp.ID, 1)
+	if !errors.Is(err, errRestoreExpired) {
+		t.Errorf("Expected errRestoreExpired, got %v", err)
+	}
+}
+
+// Purging the newest chirps and restarting mustn't hand their IDs out again,
+// notifications and cursors still point at them
+func TestPurgedChirpIDsNotReused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path)
+	mustCreateChirp(t, db, 1, "one")
+	two := mustCreateChirp(t, db, 1, "two")
+	three := mustCreateChirp(t, db, 1, "three")
+	for _, id := range []int{two.ID, three.ID} {
+		err := db.DeleteChirp(id, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backdateDeletion(db.MemoryDB, id, chirpRetention+time.Hour)
+	}
+	_, err := db.purgeDeletedChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fold the log into the snapshot so only the file is left to go on
+	db.mux.Lock()
+	err = db.compact()
+	db.mux.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openTestDB(t, path)
+	next := mustCreateChirp(t, reopened, 1, "four")
+	if next.ID <= three.ID {
+		t.Errorf("Expected a new ID after %d, got %d", three.ID, next.ID)
+	}
+}
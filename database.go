@@ -5,62 +5,158 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"sync"
 	"time"
 )
 
+// JSON file backed Store. Changes go to an append-only log next to the file
+// and get folded into it every walCompactEvery entries.
 type DB struct {
-	path        string
-	chirpsCount int
-	usersCount  int
-	chirps      DBChirp
-	mux         *sync.RWMutex
+	*MemoryDB
+	path string
+	wal  *writeAheadLog
 }
 
 type DBChirp struct {
-	Chirps        map[int]Chirp        `json:"chirps"`
-	Users         map[int]User         `json:"users"`
-	RevokedTokens map[string]time.Time `json:"revoked_tokens"`
+	Chirps map[int]Chirp `json:"chirps"`
+	Users  map[int]User  `json:"users"`
+	// Refresh token ID (jti) -> when that token expires anyway
+	RevokedTokens map[string]time.Time    `json:"revoked_tokens"`
+	Revisions     map[int][]ChirpRevision `json:"revisions"`
+	// Follower ID -> followed user ID -> when they followed
+	Follows map[int]map[int]time.Time `json:"follows"`
+	// Chirp ID -> user ID -> their reaction
+	Likes         map[int]map[int]string `json:"likes"`
+	Notifications map[int]Notification   `json:"notifications"`
+	Media         map[int]Media          `json:"media"`
+	// Keyed by their IDs, see tokens.go
+	TokenFamilies map[string]TokenFamily  `json:"token_families"`
+	RefreshTokens map[string]RefreshToken `json:"refresh_tokens"`
+	// Keyed by kid, see keys.go
+	SigningKeys map[string]SigningKey `json:"signing_keys"`
+	// Saved so IDs of purged records are never handed out again
+	NextIDs nextIDs `json:"next_ids"`
+}
+
+// The next ID each kind of record gets
+type nextIDs struct {
+	Chirps        int `json:"chirps"`
+	Users         int `json:"users"`
+	Notifications int `json:"notifications"`
+	Media         int `json:"media"`
+}
+
+// Fills in any maps missing from an older database file
+func (d *DBChirp) initMaps() {
+	if d.Chirps == nil {
+		d.Chirps = map[int]Chirp{}
+	}
+	if d.Users == nil {
+		d.Users = map[int]User{}
+	}
+	if d.RevokedTokens == nil {
+		d.RevokedTokens = map[string]time.Time{}
+	}
+	if d.Revisions == nil {
+		d.Revisions = map[int][]ChirpRevision{}
+	}
+	if d.Follows == nil {
+		d.Follows = map[int]map[int]time.Time{}
+	}
+	if d.Likes == nil {
+		d.Likes = map[int]map[int]string{}
+	}
+	if d.Notifications == nil {
+		d.Notifications = map[int]Notification{}
+	}
+	if d.Media == nil {
+		d.Media = map[int]Media{}
+	}
+	if d.TokenFamilies == nil {
+		d.TokenFamilies = map[string]TokenFamily{}
+	}
+	if d.RefreshTokens == nil {
+		d.RefreshTokens = map[string]RefreshToken{}
+	}
+	if d.SigningKeys == nil {
+		d.SigningKeys = map[string]SigningKey{}
+	}
 }
 
 type Chirp struct {
-	Author int    `json:"author_id"`
-	Body   string `json:"body"`
-	ID     int    `json:"id"`
+	Author    int        `json:"author_id"`
+	Body      string     `json:"body"`
+	ID        int        `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Set on replies, RootID is the chirp that started the conversation
+	InReplyTo int `json:"in_reply_to,omitempty"`
+	RootID    int `json:"root_id,omitempty"`
+	// A rechirp has no body of its own, a quote adds one to the original
+	RechirpOf int `json:"rechirp_of,omitempty"`
+	QuoteOf   int `json:"quote_of,omitempty"`
+	// Lowercased, parsed from Body whenever it's written
+	Hashtags []string  `json:"hashtags,omitempty"`
+	Mentions []Mention `json:"mentions,omitempty"`
+	MediaIDs []int     `json:"media_ids,omitempty"`
+}
+
+// Everything needed to post a new chirp
+type CreateChirpParams struct {
+	Body      string
+	AuthorID  int
+	InReplyTo int
+	RechirpOf int
+	QuoteOf   int
+	MediaIDs  []int
+}
+
+// A body a chirp used to have before it was edited
+type ChirpRevision struct {
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type User struct {
-	Password  string `json:"password"`
-	Email     string `json:"email"`
-	ID        int    `json:"id"`
-	ChirpyRed bool   `json:"is_chirpy_red"`
+	Password    string    `json:"password"`
+	Email       string    `json:"email"`
+	Handle      string    `json:"handle,omitempty"`
+	DisplayName string    `json:"display_name,omitempty"`
+	Bio         string    `json:"bio,omitempty"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	ID          int       `json:"id"`
+	ChirpyRed   bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
 }
 
+// Changes to a user from PUT /users, nil fields are left as they are
+type UpdateUserParams struct {
+	Email       *string
+	Password    *string
+	Handle      *string
+	DisplayName *string
+	Bio         *string
+	AvatarURL   *string
+}
+
+// Opens the database at path, creating an empty one if it doesn't exist yet
 func NewDB(path string) (*DB, error) {
-	_, err := os.Stat(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			os.Create("database.json")
-			log.Println("Database file created")
-		}
-	} else {
-		log.Println("Database file found, deleting...")
-		os.Remove("database.json")
-		log.Println("Deleted old file")
-		log.Println("Creating new file")
-		os.Create("database.json")
-		err := os.WriteFile("./database.json", []byte("{ \"chirps\": {}, \"users\": {}, \"revoked_tokens\": {}}"), 0666)
-		if err != nil {
-			log.Fatalln(err)
-		}
-	}
 	if path == "" {
 		return &DB{}, fmt.Errorf("Path is empty")
 	}
 	DB := DB{
-		path:        path,
-		chirpsCount: 1,
-		usersCount:  1,
+		MemoryDB: NewMemoryDB(),
+		path:     path,
+	}
+	DB.journal = &DB
+	err := DB.ensureDB()
+	if err != nil {
+		return &DB, err
+	}
+	DB.wal, err = openWAL(walPath(path))
+	if err != nil {
+		return &DB, err
 	}
 	err = DB.loadDB()
 	if err != nil {
@@ -69,168 +165,137 @@ func NewDB(path string) (*DB, error) {
 	return &DB, nil
 }
 
-func (db *DB) CreateChirp(body string, authorID int) (Chirp, error) {
-	if body == "" {
-		return Chirp{}, fmt.Errorf("Body is empty")
+// Deletes the database and its log so the next NewDB starts empty (dev/test only)
+func ResetDB(path string) error {
+	for _, file := range []string{path, walPath(path)} {
+		err := os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error resetting DB, %s", err)
+		}
 	}
-	newChirp := Chirp{
-		ID:     db.chirpsCount,
-		Body:   body,
-		Author: authorID,
+	log.Println("Database reset")
+	return nil
+}
+
+func walPath(path string) string {
+	return path + ".wal"
+}
+
+// Writes an empty schema if the database file is missing
+func (db *DB) ensureDB() error {
+	_, err := os.Stat(db.path)
+	if err == nil {
+		log.Println("Database file found")
+		return nil
 	}
-	db.chirps.Chirps[db.chirpsCount] = newChirp
-	db.chirpsCount++
-	err := db.writeDB()
+	if !os.IsNotExist(err) {
+		return err
+	}
+	err = db.writeDB()
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
-	return newChirp, nil
+	log.Println("Database file created")
+	return nil
 }
 
-func (db *DB) DeleteChirp(chirpID, authorID int) error {
-	checker, err := db.GetChirpByID(chirpID)
+func (db *DB) loadDB() error {
+	chirps, err := os.ReadFile(db.path)
 	if err != nil {
-		return err
+		return fmt.Errorf("Error reading file, %s", err)
 	}
-
-	if checker.Author != authorID {
-		return fmt.Errorf("Not the correct author")
+	err = json.Unmarshal(chirps, &db.chirps)
+	if err != nil {
+		return fmt.Errorf("Error loading in chirps to memeory, %s", err)
 	}
+	db.chirps.initMaps()
+	db.migrateRevokedTokens()
 
-	delete(db.chirps.Chirps, chirpID)
-	return nil
-}
-
-func (db *DB) CreateUser(email, password string) (User, error) {
-	if email == "" {
-		return User{}, fmt.Errorf("Body is empty")
+	// Pick up the IDs where the last run left off. Files from before
+	// next_ids was saved only have the records themselves to go on.
+	if db.chirps.NextIDs.Chirps > db.chirpsCount {
+		db.chirpsCount = db.chirps.NextIDs.Chirps
 	}
-	for x := range db.chirps.Users {
-		if db.chirps.Users[x].Email == email {
-			return User{}, fmt.Errorf("Email already exists")
-		}
+	if db.chirps.NextIDs.Users > db.usersCount {
+		db.usersCount = db.chirps.NextIDs.Users
 	}
-	hashedPW, err := hashPassword(password)
-	if err != nil {
-		log.Fatalln(err)
+	if db.chirps.NextIDs.Notifications > db.notificationsCount {
+		db.notificationsCount = db.chirps.NextIDs.Notifications
 	}
-	newUser := User{
-		Password:  hashedPW,
-		ID:        db.usersCount,
-		Email:     email,
-		ChirpyRed: false,
+	if db.chirps.NextIDs.Media > db.mediaCount {
+		db.mediaCount = db.chirps.NextIDs.Media
 	}
-	db.chirps.Users[db.usersCount] = newUser
-	db.usersCount++
-	err = db.writeDB()
-	if err != nil {
-		log.Fatalln(err)
+	for id := range db.chirps.Chirps {
+		if id >= db.chirpsCount {
+			db.chirpsCount = id + 1
+		}
 	}
-	return newUser, nil
-}
-
-func (db *DB) UpdateUser(email, password string, id int) (User, error) {
-	user, ok := db.chirps.Users[id]
-	if !ok {
-		return User{}, fmt.Errorf("User not found")
+	for id := range db.chirps.Users {
+		if id >= db.usersCount {
+			db.usersCount = id + 1
+		}
 	}
-	hashedPass, err := hashPassword(password)
-	if err != nil {
-		return User{}, err
+	for id := range db.chirps.Notifications {
+		if id >= db.notificationsCount {
+			db.notificationsCount = id + 1
+		}
 	}
-
-	user.Email = email
-	user.Password = hashedPass
-	db.chirps.Users[id] = user
-
-	err = db.writeDB()
-	if err != nil {
-		return User{}, err
+	for id := range db.chirps.Media {
+		if id >= db.mediaCount {
+			db.mediaCount = id + 1
+		}
 	}
 
-	return user, nil
-}
+	db.rebuildIndexes()
 
-func (db *DB) checkLogin(email string) (User, error) {
-	for _, user := range db.chirps.Users {
-		if user.Email == email {
-			return user, nil
-		}
+	// Anything after the last snapshot is still in the log
+	err = db.wal.replay(db.apply)
+	if err != nil {
+		return err
 	}
-	return User{}, fmt.Errorf("User doesn't exist")
-}
-
-func (db *DB) checkRevokedDB(token string) error {
-	_, ok := db.chirps.RevokedTokens[token]
-	if !ok {
-		return fmt.Errorf("Token not found")
+	err = db.compact()
+	if err != nil {
+		return err
 	}
+	log.Println("Chirps loaded into memory")
 	return nil
 }
 
-func (db *DB) revokeToken(token string) error {
-	_, ok := db.chirps.RevokedTokens[token]
-	if !ok {
-		db.chirps.RevokedTokens[token] = time.Now()
-		return nil
-	}
-	return fmt.Errorf("Token already revoked")
+func (db *DB) append(e walEntry) error {
+	return db.wal.append(e)
 }
 
-func (db *DB) GetChirps() (map[int]Chirp, error) {
-	return db.chirps.Chirps, nil
-}
-
-func (db *DB) GetChirpByID(id int) (Chirp, error) {
-	chirp, ok := db.chirps.Chirps[id]
-	if !ok {
-		return Chirp{}, fmt.Errorf("Chirp Does Not Exist")
-	}
-	respChirp := Chirp{
-		Author: chirp.Author,
-		Body:   chirp.Body,
-		ID:     chirp.ID,
+func (db *DB) applied() error {
+	if db.wal.entries < walCompactEvery {
+		return nil
 	}
-	return respChirp, nil
+	return db.compact()
 }
 
-func (db *DB) loadDB() error {
-	chirps, err := os.ReadFile("./database.json")
-	if err != nil {
-		log.Fatalf("Error reading file, %s", err)
-	}
-	err = json.Unmarshal(chirps, &db.chirps)
+// Snapshots everything into the main file and empties the log
+func (db *DB) compact() error {
+	err := db.writeDB()
 	if err != nil {
-		log.Fatalf("Error loading in chirps to memeory, %s", err)
+		return err
 	}
-	log.Println("Chirps loaded into memory")
-	return nil
+	return db.wal.truncate()
 }
 
 func (db *DB) writeDB() error {
+	db.chirps.NextIDs = nextIDs{
+		Chirps:        db.chirpsCount,
+		Users:         db.usersCount,
+		Notifications: db.notificationsCount,
+		Media:         db.mediaCount,
+	}
 	data, err := json.Marshal(db.chirps)
 	if err != nil {
-		log.Fatalln(err)
+		return fmt.Errorf("Error marshalling DB, %s", err)
 	}
-	err = os.WriteFile("./database.json", data, 0600)
+	err = writeFileAtomic(db.path, data, 0600)
 	if err != nil {
 		return fmt.Errorf("Error Writing to DB, %s", err)
 	}
 	log.Println("Database saved")
 	return nil
 }
-
-func (db *DB) upgradeUser(userID int) error {
-	user, ok := db.chirps.Users[userID]
-	if !ok {
-		return fmt.Errorf("User not found")
-	}
-	user.ChirpyRed = true
-	db.chirps.Users[userID] = user
-
-	err := db.writeDB()
-	if err != nil {
-		return err
-	}
-	return nil
-}
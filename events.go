@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Kinds of event on the bus
+const (
+	eventChirpCreated = "chirp_created"
+	eventChirpDeleted = "chirp_deleted"
+	eventNotification = "notification"
+)
+
+// How many past events are kept for subscribers resuming after a disconnect
+const eventHistorySize = 1000
+
+// How far a subscriber can fall behind before it gets dropped
+const subscriberBuffer = 64
+
+// Something that just happened in the store
+type Event struct {
+	ID           int64
+	Type         string
+	Chirp        *Chirp
+	Notification *Notification
+}
+
+// Fans events out to whoever is listening. Publishing never blocks, a
+// subscriber that can't keep up has its channel closed and can resume from
+// history with the last ID it saw.
+type eventBus struct {
+	mux    sync.Mutex
+	lastID int64
+	// Oldest first, at most eventHistorySize long
+	history []Event
+	subs    map[*subscription]struct{}
+}
+
+type subscription struct {
+	events chan Event
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		// IDs carry on from the clock so ones from before a restart are
+		// always older than anything new
+		lastID: time.Now().UnixMicro(),
+		subs:   map[*subscription]struct{}{},
+	}
+}
+
+func (b *eventBus) publish(e Event) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.lastID++
+	e.ID = b.lastID
+	b.history = append(b.history, e)
+	if len(b.history) > eventHistorySize {
+		b.history = b.history[len(b.history)-eventHistorySize:]
+	}
+	for sub := range b.subs {
+		select {
+		case sub.events <- e:
+		default:
+			delete(b.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// Starts listening, also returning anything in history after lastID (0 for
+// nothing). Both happen under one lock so no event is missed or repeated.
+func (b *eventBus) subscribe(lastID int64) (*subscription, []Event) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	var backlog []Event
+	if lastID > 0 {
+		for _, e := range b.history {
+			if e.ID > lastID {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+	sub := &subscription{events: make(chan Event, subscriberBuffer)}
+	b.subs[sub] = struct{}{}
+	return sub, backlog
+}
+
+func (b *eventBus) unsubscribe(sub *subscription) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.events)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const defaultTimelineLimit = 20
+
+// A refollow within this long of the last follow notification, or while it's
+// still unread, doesn't send another one
+const followNotificationWindow = 24 * time.Hour
+
+var (
+	errUserNotFound   = errors.New("User not found")
+	errCantFollowSelf = errors.New("Can't follow yourself")
+)
+
+// One side of a follow relationship
+type Follow struct {
+	UserID     int       `json:"user_id"`
+	FollowedAt time.Time `json:"followed_at"`
+}
+
+func (m *MemoryDB) applyFollow(e walEntry) {
+	follower, followee := e.UserID, e.TargetID
+	if e.Op == opUnfollow {
+		delete(m.chirps.Follows[follower], followee)
+		if len(m.chirps.Follows[follower]) == 0 {
+			delete(m.chirps.Follows, follower)
+		}
+		delete(m.index.followers[followee], follower)
+		if len(m.index.followers[followee]) == 0 {
+			delete(m.index.followers, followee)
+		}
+		return
+	}
+	if m.chirps.Follows[follower] == nil {
+		m.chirps.Follows[follower] = map[int]time.Time{}
+	}
+	if m.index.followers[followee] == nil {
+		m.index.followers[followee] = map[int]time.Time{}
+	}
+	m.chirps.Follows[follower][followee] = e.Time
+	m.index.followers[followee][follower] = e.Time
+}
+
+// Following someone twice is a no-op
+func (m *MemoryDB) Follow(followerID, followeeID int) error {
+	if followerID == followeeID {
+		return errCantFollowSelf
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.chirps.Users[followeeID]; !ok {
+		return errUserNotFound
+	}
+	if _, ok := m.chirps.Follows[followerID][followeeID]; ok {
+		return nil
+	}
+	err := m.commit(walEntry{Op: opFollow, UserID: followerID, TargetID: followeeID})
+	if err != nil {
+		return err
+	}
+	if m.recentlyNotifiedFollow(followerID, followeeID) {
+		return nil
+	}
+	return m.notify(Notification{
+		UserID:  followeeID,
+		Type:    notificationFollow,
+		ActorID: followerID,
+	})
+}
+
+// Whether followeeID has an unread or recent follow notification from
+// followerID, so unfollowing and refollowing can't spam them. Callers must
+// hold mux.
+func (m *MemoryDB) recentlyNotifiedFollow(followerID, followeeID int) bool {
+	ids := m.index.notifications[followeeID]
+	unread := m.index.unread[followeeID]
+	since := time.Now().UTC().Add(-followNotificationWindow)
+	for pos := len(ids) - 1; pos >= 0; pos-- {
+		n := m.chirps.Notifications[ids[pos]]
+		recent := n.CreatedAt.After(since)
+		if !recent && unread == 0 {
+			return false
+		}
+		if !n.Read {
+			unread--
+		}
+		if n.Type == notificationFollow && n.ActorID == followerID && (recent || !n.Read) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryDB) Unfollow(followerID, followeeID int) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.chirps.Follows[followerID][followeeID]; !ok {
+		return nil
+	}
+	return m.commit(walEntry{Op: opUnfollow, UserID: followerID, TargetID: followeeID})
+}
+
+func (m *MemoryDB) IsFollowing(followerID, followeeID int) (bool, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	_, ok := m.chirps.Follows[followerID][followeeID]
+	return ok, nil
+}
+
+// Who follows userID, most recent first
+func (m *MemoryDB) GetFollowers(userID int) ([]Follow, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	if _, ok := m.chirps.Users[userID]; !ok {
+		return nil, errUserNotFound
+	}
+	return sortFollows(m.index.followers[userID]), nil
+}
+
+// Who userID follows, most recent first
+func (m *MemoryDB) GetFollowing(userID int) ([]Follow, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	if _, ok := m.chirps.Users[userID]; !ok {
+		return nil, errUserNotFound
+	}
+	return sortFollows(m.chirps.Follows[userID]), nil
+}
+
+func sortFollows(follows map[int]time.Time) []Follow {
+	list := make([]Follow, 0, len(follows))
+	for id, since := range follows {
+		list = append(list, Follow{
+			UserID:     id,
+			FollowedAt: since,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].FollowedAt.Equal(list[j].FollowedAt) {
+			return list[i].UserID < list[j].UserID
+		}
+		return list[i].FollowedAt.After(list[j].FollowedAt)
+	})
+	return list
+}
+
+// Chirps by userID and everyone they follow, newest first, starting below
+// beforeID (0 for the top). Built on read by merging each author's index,
+// which are already in ID order, so a page costs about limit*log(authors)
+// no matter how many chirps there are. Returns whether there's more.
+func (m *MemoryDB) GetTimeline(userID, beforeID, limit int) ([]Chirp, bool, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	authors := []int{userID}
+	for followee := range m.chirps.Follows[userID] {
+		authors = append(authors, followee)
+	}
+
+	h := &timelineHeap{}
+	for _, author := range authors {
+		ids := m.index.authors[author]
+		// Start at the newest chirp older than the cursor
+		pos := len(ids) - 1
+		if beforeID > 0 {
+			pos = sort.SearchInts(ids, beforeID) - 1
+		}
+		if pos >= 0 {
+			*h = append(*h, timelineCursor{ids: ids, pos: pos})
+		}
+	}
+	heap.Init(h)
+
+	timeline := []Chirp{}
+	for h.Len() > 0 {
+		if len(timeline) == limit {
+			return timeline, true, nil
+		}
+		top := &(*h)[0]
+		chirp := m.chirps.Chirps[top.ids[top.pos]]
+		top.pos--
+		if top.pos < 0 {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+		if chirp.DeletedAt != nil {
+			continue
+		}
+		timeline = append(timeline, chirp)
+	}
+	return timeline, false, nil
+}
+
+// Max-heap of per-author positions, keyed by the chirp ID each points at
+type timelineCursor struct {
+	ids []int
+	pos int
+}
+
+type timelineHeap []timelineCursor
+
+func (h timelineHeap) Len() int           { return len(h) }
+func (h timelineHeap) Less(i, j int) bool { return h[i].ids[h[i].pos] > h[j].ids[h[j].pos] }
+func (h timelineHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *timelineHeap) Push(x any)        { *h = append(*h, x.(timelineCursor)) }
+func (h *timelineHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// Follows the user in the URL
+func (cfg *apiConfig) handlerFollow(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Follow")
+	userID, err := cfg.getUserID(r)
+	if err != nil {
+		errorResp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	targetID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, "Error getting ID")
+		return
+	}
+
+	err = cfg.database.Follow(userID, targetID)
+	if errors.Is(err, errCantFollowSelf) {
+		errorResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, errUserNotFound) {
+		errorResp(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Unfollows the user in the URL
+func (cfg *apiConfig) handlerUnfollow(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Unfollow")
+	userID, err := cfg.getUserID(r)
+	if err != nil {
+		errorResp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	targetID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, "Error getting ID")
+		return
+	}
+
+	err = cfg.database.Unfollow(userID, targetID)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerGetFollowers(w http.ResponseWriter, r *http.Request) {
+	cfg.respondFollows(w, r, cfg.database.GetFollowers)
+}
+
+func (cfg *apiConfig) handlerGetFollowing(w http.ResponseWriter, r *http.Request) {
+	cfg.respondFollows(w, r, cfg.database.GetFollowing)
+}
+
+func (cfg *apiConfig) respondFollows(w http.ResponseWriter, r *http.Request, list func(int) ([]Follow, error)) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, "Error getting ID")
+		return
+	}
+	follows, err := list(userID)
+	if err != nil {
+		errorResp(w, http.StatusNotFound, err.Error())
+		return
+	}
+	jsonResp(w, http.StatusOK, follows)
+}
+
+// Home timeline: your chirps and the people you follow, newest first, paged
+// with ?limit= and ?cursor=
+func (cfg *apiConfig) handlerGetTimeline(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Timeline")
+	userID, err := cfg.getUserID(r)
+	if err != nil {
+		errorResp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	page, err := parsePageParams(r.URL.Query())
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if page.limit == 0 {
+		page.limit = defaultTimelineLimit
+	}
+	beforeID := 0
+	if page.after != nil {
+		beforeID = page.after.ID
+	}
+
+	chirps, hasNext, err := cfg.database.GetTimeline(userID, beforeID, page.limit)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := make([]chirpsResponse, 0, len(chirps))
+	for _, chirp := range chirps {
+		resp = append(resp, newChirpResponse(chirp))
+	}
+	cfg.decorateChirps(resp, userID)
+	setPageLinks(w, r, resp, hasNext, false)
+	jsonResp(w, http.StatusOK, resp)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Unfollowing and refollowing only notifies again once the last follow
+// notification is both read and old
+func TestRefollowDoesntRenotify(t *testing.T) {
+	db := NewMemoryDB()
+	api := newTestAPI(t, db)
+	alice := api.signUp("alice@example.com")
+	bob := api.signUp("bob@example.com")
+
+	refollow := func() {
+		t.Helper()
+		err := db.Unfollow(alice.ID, bob.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Follow(alice.ID, bob.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkCount := func(want int) {
+		t.Helper()
+		notifications, _, err := db.GetNotifications(bob.ID, 0, 10, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(notifications) != want {
+			t.Fatalf("Expected %d follow notifications, got %+v", want, notifications)
+		}
+	}
+
+	err := db.Follow(alice.ID, bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refollow()
+	checkCount(1)
+
+	// Reading it isn't enough while it's recent
+	notifications, _, _ := db.GetNotifications(bob.ID, 0, 10, false)
+	_, err = db.MarkNotificationsRead(bob.ID, []int{notifications[0].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refollow()
+	checkCount(1)
+
+	// Nor is being old while it's unread
+	backdateNotification := func(id int, read bool) {
+		db.mux.Lock()
+		defer db.mux.Unlock()
+		n := db.chirps.Notifications[id]
+		n.CreatedAt = n.CreatedAt.Add(-followNotificationWindow - time.Hour)
+		if !n.Read && read {
+			db.decrementUnread(bob.ID)
+		} else if n.Read && !read {
+			db.index.unread[bob.ID]++
+		}
+		n.Read = read
+		db.chirps.Notifications[id] = n
+	}
+	backdateNotification(notifications[0].ID, false)
+	refollow()
+	checkCount(1)
+
+	backdateNotification(notifications[0].ID, true)
+	refollow()
+	checkCount(2)
+}
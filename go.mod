@@ -3,6 +3,7 @@ module github.com/ItsJustVaal/Chirpy
 go 1.20
 
 require (
+	github.com/coder/websocket v1.8.12
 	github.com/go-chi/chi/v5 v5.0.10
 	golang.org/x/crypto v0.15.0
 )
@@ -2,10 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -32,29 +34,42 @@ func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
 	</body>
 	
 	</html>
-		`, cfg.fileserverHits)))
+		`, cfg.fileserverHits.Load())))
 }
 
 // Increments total hits
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg.fileserverHits++
+		cfg.fileserverHits.Add(1)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// Serves the files in dir under prefix. Directories aren't listed, so only
+// files someone was given a link to can be fetched.
+func staticFiles(prefix, dir string) http.Handler {
+	files := http.StripPrefix(prefix, http.FileServer(http.Dir(dir)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
 // Resets total hits
 func (cfg *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
-	cfg.fileserverHits = 0
+	cfg.fileserverHits.Store(0)
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Hits reset to 0"))
 }
 
 // Creates Chirp
-func (cfg *apiConfig) AddChirp(body string, id int) (Chirp, error) {
-	newChirp, err := cfg.database.CreateChirp(body, id)
+func (cfg *apiConfig) AddChirp(params CreateChirpParams) (Chirp, error) {
+	newChirp, err := cfg.database.CreateChirp(params)
 	if err != nil {
-		log.Fatalln("Failed to add Chirp")
+		log.Println("Failed to add Chirp")
 		return Chirp{}, err
 	}
 	return newChirp, nil
@@ -71,72 +86,78 @@ func (cfg *apiConfig) handlerAddUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	newUser, err := cfg.database.CreateUser(checker.Email, checker.Password)
+	newUser, err := cfg.database.CreateUser(checker.Email, checker.Password, checker.Handle)
+	if errors.Is(err, errEmailTaken) || errors.Is(err, errHandleTaken) {
+		errorResp(w, http.StatusConflict, err.Error())
+		return
+	}
+	if errors.Is(err, errInvalidHandle) {
+		errorResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	if err != nil {
-		log.Fatalln("Failed to add User")
+		errorResp(w, http.StatusInternalServerError, "Failed to add User")
 		return
 	}
 
-	jsonResp(w, http.StatusCreated, userResponse{
-		Email:     newUser.Email,
-		ID:        newUser.ID,
-		ChirpyRed: newUser.ChirpyRed,
-	})
+	jsonResp(w, http.StatusCreated, newUserResponse(newUser))
 }
 
 // Updates user
 func (cfg *apiConfig) handlerUpdateUser(w http.ResponseWriter, r *http.Request) {
 	log.Println("Calling Update User")
-	token, err := GetBearerToken(r.Header)
-	if err != nil {
-		errorResp(w, http.StatusUnauthorized, "Couldn't find JWT")
-		return
-	}
-	user, err := ValidateJWT(token, cfg.JWTSecret)
+	userIDInt, err := cfg.getUserID(r)
 	if err != nil {
 		errorResp(w, http.StatusUnauthorized, "Couldn't Validate Token")
 		return
 	}
 
+	// Pointers so a field that's left out isn't cleared
+	type updateRequest struct {
+		Email       *string `json:"email"`
+		Password    *string `json:"password"`
+		Handle      *string `json:"handle"`
+		DisplayName *string `json:"display_name"`
+		Bio         *string `json:"bio"`
+		AvatarURL   *string `json:"avatar_url"`
+	}
 	decoder := json.NewDecoder(r.Body)
-	checker := jsonBody{}
+	checker := updateRequest{}
 	err = decoder.Decode(&checker)
 	if err != nil {
 		errorResp(w, http.StatusInternalServerError, "Couldn't decode parameters")
 		return
 	}
-	userIDInt, err := strconv.Atoi(user)
-	if err != nil {
-		errorResp(w, http.StatusInternalServerError, "Couldn't parse user ID")
+	updatedUser, err := cfg.database.UpdateUser(userIDInt, UpdateUserParams{
+		Email:       checker.Email,
+		Password:    checker.Password,
+		Handle:      checker.Handle,
+		DisplayName: checker.DisplayName,
+		Bio:         checker.Bio,
+		AvatarURL:   checker.AvatarURL,
+	})
+	if errors.Is(err, errEmailTaken) || errors.Is(err, errHandleTaken) {
+		errorResp(w, http.StatusConflict, err.Error())
+		return
+	}
+	if errors.Is(err, errInvalidProfile) || errors.Is(err, errInvalidHandle) {
+		errorResp(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	updatedUser, err := cfg.database.UpdateUser(checker.Email, checker.Password, userIDInt)
 	if err != nil {
 		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
 	}
-	jsonResp(w, http.StatusOK, userResponse{
-		Email: updatedUser.Email,
-		ID:    userIDInt,
-	})
+	jsonResp(w, http.StatusOK, newUserResponse(updatedUser))
 }
 
 // Checks if chirp is valid
 func (cfg *apiConfig) handlerValidateChirp(w http.ResponseWriter, r *http.Request) {
-	token, err := GetBearerToken(r.Header)
-	if err != nil {
-		errorResp(w, http.StatusUnauthorized, "Not authenticated")
-		return
-	}
-	user, err := ValidateJWT(token, cfg.JWTSecret)
+	id, err := cfg.getUserID(r)
 	if err != nil {
 		errorResp(w, http.StatusUnauthorized, err.Error())
 		return
 	}
-	id, err := strconv.Atoi(user)
-	if err != nil {
-		errorResp(w, http.StatusInternalServerError, "Error getting ID")
-		return
-	}
 
 	w.Header().Set("Content-Type", "application/json")
 	decoder := json.NewDecoder(r.Body)
@@ -146,33 +167,56 @@ func (cfg *apiConfig) handlerValidateChirp(w http.ResponseWriter, r *http.Reques
 		errorResp(w, http.StatusInternalServerError, "Couldn't decode parameters")
 		return
 	}
-	if len(checker.Body) > 140 {
-		errorResp(w, http.StatusBadRequest, "Chirp is too long")
+	cleanBody := ""
+	if checker.RechirpOf != 0 {
+		// A rechirp is just a pointer, comments go in a quote
+		if checker.Body != "" || checker.QuoteOf != 0 || checker.InReplyTo != 0 || len(checker.MediaIDs) > 0 {
+			errorResp(w, http.StatusBadRequest, "Rechirps can't have a body or media, use quote_of instead")
+			return
+		}
+	} else if checker.Body != "" || len(checker.MediaIDs) == 0 {
+		// The body can only be left out when there's something attached
+		cleanBody, err = validateChirpBody(checker.Body)
+		if err != nil {
+			errorResp(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	newChirp, err := cfg.AddChirp(CreateChirpParams{
+		Body:      cleanBody,
+		AuthorID:  id,
+		InReplyTo: checker.InReplyTo,
+		RechirpOf: checker.RechirpOf,
+		QuoteOf:   checker.QuoteOf,
+		MediaIDs:  checker.MediaIDs,
+	})
+	if errors.Is(err, errParentNotFound) || errors.Is(err, errOriginalNotFound) || errors.Is(err, errMediaNotFound) {
+		errorResp(w, http.StatusNotFound, err.Error())
 		return
 	}
-
-	blockedWords := map[string]struct{}{
-		"kerfuffle": {},
-		"sharbert":  {},
-		"fornax":    {},
+	if errors.Is(err, errTooManyMedia) {
+		errorResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, errAlreadyRechirped) || errors.Is(err, errMediaInUse) {
+		errorResp(w, http.StatusConflict, err.Error())
+		return
 	}
-	cleanBody := cleanInput(checker.Body, blockedWords)
-	newChirp, err := cfg.AddChirp(cleanBody, id)
 	if err != nil {
-		log.Fatalln(err)
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
 	}
-	jsonResp(w, http.StatusCreated, chirpsResponse{
-		Author: newChirp.Author,
-		Body:   newChirp.Body,
-		ID:     newChirp.ID,
-	})
+	resp := []chirpsResponse{newChirpResponse(newChirp)}
+	cfg.decorateChirps(resp, id)
+	jsonResp(w, http.StatusCreated, resp[0])
 }
 
-// Gets all chirps
+// Gets all chirps, or one author's chirps with ?author_id=, paged with
+// ?limit= and the cursors in the Link header
 func (cfg *apiConfig) handlerGetChirps(w http.ResponseWriter, r *http.Request) {
-	allChirps, err := cfg.database.GetChirps()
+	page, err := parsePageParams(r.URL.Query())
 	if err != nil {
-		errorResp(w, http.StatusNoContent, "No Chirps")
+		errorResp(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	var id int
@@ -184,30 +228,30 @@ func (cfg *apiConfig) handlerGetChirps(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	var finalChirps []chirpsResponse
-
-	if id != 0 {
-		for _, y := range allChirps {
-			if y.Author == id {
-				finalChirps = append(finalChirps, chirpsResponse{
-					Author: y.Author,
-					Body:   y.Body,
-					ID:     y.ID,
-				})
-			}
-		}
+
+	sortBy := r.URL.Query().Get("sort_by")
+	sortMethod := r.URL.Query().Get("sort")
+	var pageChirps []chirpsResponse
+	var hasNext, hasPrev bool
+	if sortBy == "updated_at" {
+		// Edits move chirps around in this order, so there's no index for it
+		pageChirps, hasNext, hasPrev, err = cfg.pageChirpsByUpdate(id, sortMethod, page)
 	} else {
-		for _, y := range allChirps {
-			finalChirps = append(finalChirps, chirpsResponse{
-				Author: y.Author,
-				Body:   y.Body,
-				ID:     y.ID,
-			})
+		var chirps []Chirp
+		desc := sortMethod != "" && sortMethod != "asc"
+		chirps, hasNext, hasPrev, err = cfg.pageChirpsByID(id, desc, page)
+		pageChirps = make([]chirpsResponse, 0, len(chirps))
+		for _, chirp := range chirps {
+			pageChirps = append(pageChirps, newChirpResponse(chirp))
 		}
 	}
-	sortMethod := r.URL.Query().Get("sort")
-	sortedChirps := sortChirps(finalChirps, sortMethod)
-	finalResp, err := json.Marshal(sortedChirps)
+	if err != nil {
+		errorResp(w, http.StatusNoContent, "No Chirps")
+		return
+	}
+	cfg.decorateChirps(pageChirps, cfg.optionalUserID(r))
+	setPageLinks(w, r, pageChirps, hasNext, hasPrev)
+	finalResp, err := json.Marshal(pageChirps)
 	if err != nil {
 		errorResp(w, http.StatusInternalServerError, "Failed to Marshal")
 		return
@@ -215,6 +259,31 @@ func (cfg *apiConfig) handlerGetChirps(w http.ResponseWriter, r *http.Request) {
 	w.Write(finalResp)
 }
 
+// Sorts every chirp by when it was last edited and cuts a page out
+func (cfg *apiConfig) pageChirpsByUpdate(authorID int, sortMethod string, page pageParams) ([]chirpsResponse, bool, bool, error) {
+	var allChirps []Chirp
+	var err error
+	if authorID != 0 {
+		allChirps, err = cfg.database.GetChirpsByAuthor(authorID)
+	} else {
+		var chirpMap map[int]Chirp
+		chirpMap, err = cfg.database.GetChirps()
+		for _, y := range chirpMap {
+			allChirps = append(allChirps, y)
+		}
+	}
+	if err != nil {
+		return nil, false, false, err
+	}
+	finalChirps := []chirpsResponse{}
+	for _, y := range allChirps {
+		finalChirps = append(finalChirps, newChirpResponse(y))
+	}
+	sortedChirps := sortChirps(finalChirps, "updated_at", sortMethod)
+	pageChirps, hasNext, hasPrev := paginateChirps(sortedChirps, chirpLess("updated_at", sortMethod), page)
+	return pageChirps, hasNext, hasPrev, nil
+}
+
 // Gets a chirp by its ID
 func (cfg *apiConfig) handlerGetChirpByID(w http.ResponseWriter, r *http.Request) {
 	chirpIDString := chi.URLParam(r, "id")
@@ -228,12 +297,10 @@ func (cfg *apiConfig) handlerGetChirpByID(w http.ResponseWriter, r *http.Request
 		errorResp(w, http.StatusNotFound, "Chirp Doesn't Exist")
 		return
 	}
-	if err != nil {
-		errorResp(w, http.StatusInternalServerError, "Failed to Marshal")
-		return
-	}
 
-	jsonResp(w, http.StatusOK, chirp)
+	resp := []chirpsResponse{newChirpResponse(chirp)}
+	cfg.decorateChirps(resp, cfg.optionalUserID(r))
+	jsonResp(w, http.StatusOK, resp[0])
 }
 
 func (cfg *apiConfig) handlerDeleteChirpByID(w http.ResponseWriter, r *http.Request) {
@@ -244,37 +311,138 @@ func (cfg *apiConfig) handlerDeleteChirpByID(w http.ResponseWriter, r *http.Requ
 		errorResp(w, http.StatusInternalServerError, "Error getting ID")
 		return
 	}
-	token, err := GetBearerToken(r.Header)
+	userID, err := cfg.getUserID(r)
+	if err != nil {
+		errorResp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	log.Println("Deleting")
+	err = cfg.database.DeleteChirp(chirpID, userID)
+	if errors.Is(err, errChirpNotFound) {
+		errorResp(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, errNotAuthor) {
+		errorResp(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Lets the author change a chirp shortly after posting it
+func (cfg *apiConfig) handlerEditChirp(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Edit Chirp")
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		errorResp(w, http.StatusUnauthorized, "Not authenticated")
+		errorResp(w, http.StatusInternalServerError, "Error getting ID")
 		return
 	}
-	user, err := ValidateJWT(token, cfg.JWTSecret)
+	userID, err := cfg.getUserID(r)
 	if err != nil {
 		errorResp(w, http.StatusUnauthorized, err.Error())
 		return
 	}
-	userID, err := strconv.Atoi(user)
+
+	decoder := json.NewDecoder(r.Body)
+	checker := jsonBody{}
+	err = decoder.Decode(&checker)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		return
+	}
+	cleanBody, err := validateChirpBody(checker.Body)
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chirp, err := cfg.database.EditChirp(chirpID, userID, cleanBody)
+	if errors.Is(err, errChirpNotFound) {
+		errorResp(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, errNotAuthor) || errors.Is(err, errEditExpired) {
+		errorResp(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if errors.Is(err, errCantEditRechirp) {
+		errorResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := []chirpsResponse{newChirpResponse(chirp)}
+	cfg.decorateChirps(resp, userID)
+	jsonResp(w, http.StatusOK, resp[0])
+}
+
+// Lists every version of a chirp, oldest first
+func (cfg *apiConfig) handlerGetChirpHistory(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		errorResp(w, http.StatusInternalServerError, "Error getting ID")
 		return
 	}
+	history, err := cfg.database.GetChirpHistory(chirpID)
+	if err != nil {
+		errorResp(w, http.StatusNotFound, "Chirp Doesn't Exist")
+		return
+	}
+	jsonResp(w, http.StatusOK, history)
+}
 
-	log.Println("Deleting")
-	err = cfg.database.DeleteChirp(chirpID, userID)
+// Undoes a delete if the author asks within the retention window
+func (cfg *apiConfig) handlerRestoreChirp(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Restore Chirp")
+	chirpIDString := chi.URLParam(r, "id")
+	chirpID, err := strconv.Atoi(chirpIDString)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, "Error getting ID")
+		return
+	}
+	userID, err := cfg.getUserID(r)
 	if err != nil {
+		errorResp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	chirp, err := cfg.database.RestoreChirp(chirpID, userID)
+	if errors.Is(err, errChirpNotFound) {
+		errorResp(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, errNotAuthor) {
 		errorResp(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if errors.Is(err, errRestoreExpired) {
+		errorResp(w, http.StatusGone, err.Error())
+		return
+	}
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
 	}
-	jsonResp(w, http.StatusOK, "Deleted")
+	resp := []chirpsResponse{newChirpResponse(chirp)}
+	cfg.decorateChirps(resp, userID)
+	jsonResp(w, http.StatusOK, resp[0])
 }
 
 // Checks login and grants token
 func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	log.Println("Calling Login")
 	type loginResponse struct {
-		User
+		userResponse
 		Token        string `json:"token"`
 		RefreshToken string `json:"refresh_token"`
+		SessionID    string `json:"session_id"`
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -298,33 +466,39 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := MakeJWTAccess(user.ID, cfg.JWTSecret, time.Duration(60)*time.Minute)
+	// Each login is its own session
+	refreshToken, err := cfg.database.StartTokenFamily(user.ID, clientUserAgent(r), clientIP(r))
 	if err != nil {
-		errorResp(w, http.StatusInternalServerError, "Couldnt make JWT Access Token")
+		errorResp(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	refresh, err := MakeJWTRefresh(user.ID, cfg.JWTSecret, time.Duration(1440)*time.Hour)
+	token, err := MakeJWTAccess(user.ID, cfg.keys, time.Duration(60)*time.Minute, refreshToken.FamilyID)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, "Couldnt make JWT Access Token")
+		return
+	}
+	refresh, err := MakeJWTRefresh(user.ID, cfg.keys, time.Until(refreshToken.ExpiresAt), refreshToken.ID)
 	if err != nil {
 		errorResp(w, http.StatusInternalServerError, "Couldnt make JWT Access Token")
 		return
 	}
 
 	jsonResp(w, http.StatusOK, loginResponse{
-		User: User{
-			ID:        user.ID,
-			Email:     user.Email,
-			ChirpyRed: user.ChirpyRed,
-		},
+		userResponse: newUserResponse(user),
 		Token:        token,
 		RefreshToken: refresh,
+		SessionID:    refreshToken.FamilyID,
 	})
 }
 
+// Swaps a refresh token for a new access token and a new refresh token, the
+// old refresh token stops working
 func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 	log.Println("Calling Refresh")
 	type refreshResp struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 	w.Header().Set("Content-Type", "application/json")
 	decoder := json.NewDecoder(r.Body)
@@ -340,32 +514,61 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 		errorResp(w, http.StatusUnauthorized, "Couldn't find JWT")
 		return
 	}
-	user, err := ValidateJWTRefresh(token, cfg.JWTSecret)
+	claims, err := parseRefreshToken(token, cfg.keys)
 	if err != nil {
-		errorResp(w, http.StatusUnauthorized, "test 1")
+		errorResp(w, http.StatusUnauthorized, "Invalid refresh token")
 		return
 	}
 
-	err = cfg.database.checkRevokedDB(token)
+	err = cfg.database.checkRevokedDB(claims.ID)
 	if err == nil {
 		errorResp(w, http.StatusUnauthorized, "Token revoked")
 		return
 	}
-	userIDInt, err := strconv.Atoi(user)
+	userIDInt, err := strconv.Atoi(claims.Subject)
 	if err != nil {
 		errorResp(w, http.StatusInternalServerError, "Couldn't parse user ID")
 		return
 	}
 
-	newToken, err := MakeJWTAccess(userIDInt, cfg.JWTSecret, time.Duration(60)*time.Minute)
+	var rotated RefreshToken
+	if claims.ID == "" {
+		// From before rotation, it's swapped once for a token in a new family
+		if claims.ExpiresAt == nil {
+			errorResp(w, http.StatusUnauthorized, errTokenNotFound.Error())
+			return
+		}
+		rotated, err = cfg.database.AdoptLegacyRefreshToken(token, claims.ExpiresAt.Time, userIDInt, clientUserAgent(r), clientIP(r))
+	} else {
+		rotated, err = cfg.database.RotateRefreshToken(claims.ID, clientIP(r))
+	}
+	if errors.Is(err, errTokenNotFound) || errors.Is(err, errTokenRevoked) || errors.Is(err, errTokenReused) {
+		if errors.Is(err, errTokenReused) {
+			log.Printf("Refresh token reuse for user %d, revoked its family", userIDInt)
+		}
+		errorResp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
 	if err != nil {
-		errorResp(w, http.StatusInternalServerError, "Test 2")
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	newToken, err := MakeJWTAccess(userIDInt, cfg.keys, time.Duration(60)*time.Minute, rotated.FamilyID)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, "Couldn't make JWT")
+		return
+	}
+	newRefresh, err := MakeJWTRefresh(userIDInt, cfg.keys, time.Until(rotated.ExpiresAt), rotated.ID)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, "Couldnt make JWT Refresh Token")
 		return
 	}
 
 	log.Println("Passed all checks, responding")
 	jsonResp(w, http.StatusOK, refreshResp{
-		Token: newToken,
+		Token:        newToken,
+		RefreshToken: newRefresh,
 	})
 
 }
@@ -386,17 +589,31 @@ func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 		errorResp(w, http.StatusUnauthorized, "Couldn't find JWT")
 		return
 	}
-	_, err = ValidateJWTRefresh(token, cfg.JWTSecret)
+	claims, err := parseRefreshToken(token, cfg.keys)
 	if err != nil {
 		errorResp(w, http.StatusUnauthorized, err.Error())
 		return
 	}
 
-	err = cfg.database.revokeToken(token)
+	tokenID := claims.ID
+	if tokenID == "" {
+		tokenID = legacyTokenID(token)
+	}
+	expiresAt := time.Now().UTC().Add(refreshTokenLifetime)
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	err = cfg.database.revokeToken(tokenID, expiresAt)
 	if err != nil {
 		errorResp(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	// Logging out ends the whole login, not just this one token
+	err = cfg.database.RevokeTokenFamily(tokenID)
+	if err != nil && !errors.Is(err, errTokenNotFound) {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 	jsonResp(w, http.StatusOK, "Token Revoked")
 }
 
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultTrendingWindow = 24 * time.Hour
+	maxTrendingWindow     = 7 * 24 * time.Hour
+	defaultTrendingLimit  = 10
+)
+
+// A # at the start or after anything that isn't part of a word
+var hashtagRegex = regexp.MustCompile(`(?:^|[^\w&#])#(\w{1,50})`)
+
+type TrendingTag struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// Lowercased tags in the order they first appear, no duplicates
+func extractHashtags(body string) []string {
+	var tags []string
+	seen := map[string]struct{}{}
+	for _, match := range hashtagRegex.FindAllStringSubmatch(body, -1) {
+		tag := strings.ToLower(match[1])
+		if _, ok := seen[tag]; ok {
+			continue
+		}
+		seen[tag] = struct{}{}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// Chirps tagged with tag, newest first, starting below beforeID (0 for the
+// top). Returns whether there's more.
+func (m *MemoryDB) GetChirpsByHashtag(tag string, beforeID, limit int) ([]Chirp, bool, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	ids := m.index.hashtags[strings.ToLower(tag)]
+	pos := len(ids) - 1
+	if beforeID > 0 {
+		pos = sort.SearchInts(ids, beforeID) - 1
+	}
+
+	chirps := []Chirp{}
+	for ; pos >= 0; pos-- {
+		chirp := m.chirps.Chirps[ids[pos]]
+		if chirp.DeletedAt != nil {
+			continue
+		}
+		if len(chirps) == limit {
+			return chirps, true, nil
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, false, nil
+}
+
+// Most used tags in chirps posted within window, busiest first
+func (m *MemoryDB) GetTrendingHashtags(window time.Duration, limit int) ([]TrendingTag, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	cutoff := time.Now().Add(-window)
+
+	var trending []TrendingTag
+	for tag, ids := range m.index.hashtags {
+		count := 0
+		// IDs go up with time, so walk back from the newest until we leave the window
+		for i := len(ids) - 1; i >= 0; i-- {
+			chirp := m.chirps.Chirps[ids[i]]
+			if chirp.CreatedAt.Before(cutoff) {
+				break
+			}
+			if chirp.DeletedAt == nil {
+				count++
+			}
+		}
+		if count > 0 {
+			trending = append(trending, TrendingTag{
+				Tag:   tag,
+				Count: count,
+			})
+		}
+	}
+	sort.Slice(trending, func(i, j int) bool {
+		if trending[i].Count == trending[j].Count {
+			return trending[i].Tag < trending[j].Tag
+		}
+		return trending[i].Count > trending[j].Count
+	})
+	if len(trending) > limit {
+		trending = trending[:limit]
+	}
+	return trending, nil
+}
+
+// Chirps with a hashtag, newest first, paged with ?limit= and ?cursor=
+func (cfg *apiConfig) handlerGetHashtagChirps(w http.ResponseWriter, r *http.Request) {
+	tag := strings.TrimPrefix(chi.URLParam(r, "tag"), "#")
+	page, err := parsePageParams(r.URL.Query())
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if page.limit == 0 {
+		page.limit = defaultTimelineLimit
+	}
+	beforeID := 0
+	if page.after != nil {
+		beforeID = page.after.ID
+	}
+
+	chirps, hasNext, err := cfg.database.GetChirpsByHashtag(tag, beforeID, page.limit)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := make([]chirpsResponse, 0, len(chirps))
+	for _, chirp := range chirps {
+		resp = append(resp, newChirpResponse(chirp))
+	}
+	cfg.decorateChirps(resp, cfg.optionalUserID(r))
+	setPageLinks(w, r, resp, hasNext, false)
+	jsonResp(w, http.StatusOK, resp)
+}
+
+// Top hashtags over the last ?hours= (default 24), up to ?limit= of them
+func (cfg *apiConfig) handlerGetTrending(w http.ResponseWriter, r *http.Request) {
+	window := defaultTrendingWindow
+	if s := r.URL.Query().Get("hours"); s != "" {
+		hours, err := strconv.Atoi(s)
+		if err != nil || hours < 1 {
+			errorResp(w, http.StatusBadRequest, "Invalid hours")
+			return
+		}
+		window = time.Duration(hours) * time.Hour
+		if window > maxTrendingWindow {
+			window = maxTrendingWindow
+		}
+	}
+	limit := defaultTrendingLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			errorResp(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+	}
+
+	trending, err := cfg.database.GetTrendingHashtags(window, limit)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if trending == nil {
+		trending = []TrendingTag{}
+	}
+	jsonResp(w, http.StatusOK, trending)
+}
@@ -8,6 +8,7 @@ func middlewareCors(next http.Handler) http.Handler {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
+		w.Header().Set("Access-Control-Expose-Headers", "Link, X-Next-Cursor")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"sort"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -21,6 +25,23 @@ func cleanInput(body string, blockedWords map[string]struct{}) string {
 	return strings.Join(splitString, " ")
 }
 
+// Checks length and censors a chirp body, returns the cleaned body
+func validateChirpBody(body string) (string, error) {
+	if body == "" {
+		return "", fmt.Errorf("Chirp is empty")
+	}
+	if len(body) > 140 {
+		return "", fmt.Errorf("Chirp is too long")
+	}
+
+	blockedWords := map[string]struct{}{
+		"kerfuffle": {},
+		"sharbert":  {},
+		"fornax":    {},
+	}
+	return cleanInput(body, blockedWords), nil
+}
+
 // Reusable http response functions
 // Errorfunc
 func errorResp(w http.ResponseWriter, errorCode int, message string) {
@@ -43,9 +64,12 @@ func jsonResp(w http.ResponseWriter, statusCode int, response interface{}) {
 	w.Write(data)
 }
 
+// bcrypt work factor, tests turn it down
+var passwordCost = bcrypt.DefaultCost
+
 // Hash password
 func hashPassword(password string) (string, error) {
-	newPass, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	newPass, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
 	if err != nil {
 		return " ", err
 	}
@@ -53,18 +77,90 @@ func hashPassword(password string) (string, error) {
 
 }
 
-func sortChirps(chirps []chirpsResponse, sortOrder string) []chirpsResponse {
+func newChirpResponse(chirp Chirp) chirpsResponse {
+	return chirpsResponse{
+		Author:    chirp.Author,
+		Body:      chirp.Body,
+		ID:        chirp.ID,
+		CreatedAt: chirp.CreatedAt,
+		UpdatedAt: chirp.UpdatedAt,
+		InReplyTo: chirp.InReplyTo,
+		RootID:    chirp.RootID,
+		RechirpOf: chirp.RechirpOf,
+		QuoteOf:   chirp.QuoteOf,
+		Hashtags:  chirp.Hashtags,
+		Mentions:  chirp.Mentions,
+		MediaIDs:  chirp.MediaIDs,
+	}
+}
+
+func newUserResponse(user User) userResponse {
+	return userResponse{
+		Email:       user.Email,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   user.AvatarURL,
+		ID:          user.ID,
+		ChirpyRed:   user.ChirpyRed,
+		CreatedAt:   user.CreatedAt,
+		UpdatedAt:   user.UpdatedAt,
+	}
+}
+
+// Fills in everything on a chirpsResponse that isn't stored on the Chirp
+func (cfg *apiConfig) decorateChirps(chirps []chirpsResponse, viewerID int) {
+	cfg.addLikes(chirps, viewerID)
+	cfg.addMedia(chirps)
+	cfg.addOriginals(chirps, viewerID)
+}
+
+func sortChirps(chirps []chirpsResponse, sortBy, sortOrder string) []chirpsResponse {
 	log.Println("Inside sort")
-	log.Printf("Sort Method, %s", sortOrder)
+	log.Printf("Sort Method, %s %s", sortBy, sortOrder)
+	less := chirpLess(sortBy, sortOrder)
+	sort.Slice(chirps, func(i, j int) bool {
+		return less(chirps[i], chirps[j])
+	})
+
+	return chirps
+}
+
+// Ordering for ?sort_by=id|created_at|updated_at and ?sort=asc|desc, IDs
+// break ties so the order is total
+func chirpLess(sortBy, sortOrder string) func(a, b chirpsResponse) bool {
+	key := func(a, b chirpsResponse) int {
+		var x, y time.Time
+		switch sortBy {
+		case "created_at":
+			x, y = a.CreatedAt, b.CreatedAt
+		case "updated_at":
+			x, y = a.UpdatedAt, b.UpdatedAt
+		}
+		if x.Before(y) {
+			return -1
+		}
+		if x.After(y) {
+			return 1
+		}
+		return a.ID - b.ID
+	}
 	if sortOrder == "asc" || sortOrder == "" {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].ID < chirps[j].ID
-		})
-	} else {
-		sort.Slice(chirps, func(i, j int) bool {
-			return chirps[i].ID > chirps[j].ID
-		})
+		return func(a, b chirpsResponse) bool {
+			return key(a, b) < 0
+		}
 	}
+	return func(a, b chirpsResponse) bool {
+		return key(a, b) > 0
+	}
+}
 
-	return chirps
+// 128 random bits as hex, for IDs nobody should be able to guess
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("Error making random ID, %s", err)
+	}
+	return hex.EncodeToString(b), nil
 }
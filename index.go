@@ -0,0 +1,171 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// In-memory lookup tables derived from DBChirp. They're never written to
+// disk, apply keeps them current and rebuildIndexes recreates them on load.
+type dbIndexes struct {
+	// Lowercased email -> user ID
+	emails map[string]int
+	// Lowercased handle -> user ID
+	handles map[string]int
+	// Every chirp ID, ascending, deleted ones until they're purged
+	chirps []int
+	// Author ID -> that author's chirp IDs, ascending
+	authors map[int][]int
+	// Chirp ID -> IDs of its direct replies, ascending
+	replies map[int][]int
+	// Chirp ID -> IDs of chirps rechirping it, ascending
+	rechirps map[int][]int
+	// Lowercased hashtag -> IDs of chirps using it, ascending
+	hashtags map[string][]int
+	// User ID -> their followers -> when they followed, the reverse of Follows
+	followers map[int]map[int]time.Time
+	// User ID -> IDs of their notifications, ascending
+	notifications map[int][]int
+	// Search term -> chirp ID -> the term's positions in the body
+	terms map[string]map[int][]int
+	// Search term -> IDs of users with it in their handle or display name
+	userTerms map[string]map[int]struct{}
+	// Media ID -> the chirp it's attached to
+	mediaChirps map[int]int
+	// User ID -> how many of their notifications are unread
+	unread map[int]int
+}
+
+func newIndexes() dbIndexes {
+	return dbIndexes{
+		emails:        map[string]int{},
+		handles:       map[string]int{},
+		authors:       map[int][]int{},
+		replies:       map[int][]int{},
+		rechirps:      map[int][]int{},
+		hashtags:      map[string][]int{},
+		followers:     map[int]map[int]time.Time{},
+		notifications: map[int][]int{},
+		terms:         map[string]map[int][]int{},
+		userTerms:     map[string]map[int]struct{}{},
+		mediaChirps:   map[int]int{},
+		unread:        map[int]int{},
+	}
+}
+
+func emailKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func (m *MemoryDB) rebuildIndexes() {
+	m.index = newIndexes()
+	for _, user := range m.chirps.Users {
+		m.index.emails[emailKey(user.Email)] = user.ID
+		if user.Handle != "" {
+			m.index.handles[handleKey(user.Handle)] = user.ID
+		}
+		m.indexUserText(user)
+	}
+	for _, chirp := range m.chirps.Chirps {
+		m.indexChirp(chirp)
+	}
+	for _, n := range m.chirps.Notifications {
+		m.index.notifications[n.UserID] = insertID(m.index.notifications[n.UserID], n.ID)
+		if !n.Read {
+			m.index.unread[n.UserID]++
+		}
+	}
+	for follower, following := range m.chirps.Follows {
+		for followee, since := range following {
+			if m.index.followers[followee] == nil {
+				m.index.followers[followee] = map[int]time.Time{}
+			}
+			m.index.followers[followee][follower] = since
+		}
+	}
+}
+
+// Call before the user is stored so a changed email drops its old entry
+func (m *MemoryDB) indexUser(user User) {
+	old, ok := m.chirps.Users[user.ID]
+	if ok && emailKey(old.Email) != emailKey(user.Email) {
+		delete(m.index.emails, emailKey(old.Email))
+	}
+	m.index.emails[emailKey(user.Email)] = user.ID
+	if ok && old.Handle != "" && handleKey(old.Handle) != handleKey(user.Handle) {
+		delete(m.index.handles, handleKey(old.Handle))
+	}
+	if user.Handle != "" {
+		m.index.handles[handleKey(user.Handle)] = user.ID
+	}
+	if ok {
+		m.unindexUserText(old)
+	}
+	m.indexUserText(user)
+}
+
+func (m *MemoryDB) indexChirp(chirp Chirp) {
+	m.index.chirps = insertID(m.index.chirps, chirp.ID)
+	m.index.authors[chirp.Author] = insertID(m.index.authors[chirp.Author], chirp.ID)
+	if chirp.InReplyTo != 0 {
+		m.index.replies[chirp.InReplyTo] = insertID(m.index.replies[chirp.InReplyTo], chirp.ID)
+	}
+	if chirp.RechirpOf != 0 {
+		m.index.rechirps[chirp.RechirpOf] = insertID(m.index.rechirps[chirp.RechirpOf], chirp.ID)
+	}
+	for _, tag := range chirp.Hashtags {
+		m.index.hashtags[tag] = insertID(m.index.hashtags[tag], chirp.ID)
+	}
+	for _, id := range chirp.MediaIDs {
+		m.index.mediaChirps[id] = chirp.ID
+	}
+	m.indexChirpText(chirp)
+}
+
+func (m *MemoryDB) unindexChirp(chirp Chirp) {
+	if i := sort.SearchInts(m.index.chirps, chirp.ID); i < len(m.index.chirps) && m.index.chirps[i] == chirp.ID {
+		m.index.chirps = append(m.index.chirps[:i], m.index.chirps[i+1:]...)
+	}
+	removeID(m.index.authors, chirp.Author, chirp.ID)
+	if chirp.InReplyTo != 0 {
+		removeID(m.index.replies, chirp.InReplyTo, chirp.ID)
+	}
+	if chirp.RechirpOf != 0 {
+		removeID(m.index.rechirps, chirp.RechirpOf, chirp.ID)
+	}
+	for _, tag := range chirp.Hashtags {
+		removeID(m.index.hashtags, tag, chirp.ID)
+	}
+	for _, id := range chirp.MediaIDs {
+		delete(m.index.mediaChirps, id)
+	}
+	m.unindexChirpText(chirp)
+}
+
+// Adds id to a sorted list of IDs unless it's already there
+func insertID(ids []int, id int) []int {
+	i := sort.SearchInts(ids, id)
+	if i < len(ids) && ids[i] == id {
+		return ids
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
+
+// Takes id out of index[key], dropping the key once its list is empty
+func removeID[K comparable](index map[K][]int, key K, id int) {
+	ids := index[key]
+	i := sort.SearchInts(ids, id)
+	if i == len(ids) || ids[i] != id {
+		return
+	}
+	ids = append(ids[:i], ids[i+1:]...)
+	if len(ids) == 0 {
+		delete(index, key)
+		return
+	}
+	index[key] = ids
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// Periodically clears out data nobody can use anymore
+func (cfg *apiConfig) runJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		cfg.cleanUp()
+	}
+}
+
+// One pass of the janitor. Media files go once the DB has let go of them.
+func (cfg *apiConfig) cleanUp() {
+	purged, err := cfg.database.purgeDeletedChirps()
+	if err != nil {
+		log.Printf("Janitor failed purging chirps, %s", err)
+	}
+	for _, media := range purged {
+		cfg.removeMediaFiles(media)
+	}
+	unattached, err := cfg.database.pruneUnattachedMedia()
+	if err != nil {
+		log.Printf("Janitor failed pruning uploads, %s", err)
+	}
+	for _, media := range unattached {
+		cfg.removeMediaFiles(media)
+	}
+	err = cfg.database.pruneExpiredTokens()
+	if err != nil {
+		log.Printf("Janitor failed pruning tokens, %s", err)
+	}
+	err = cfg.keys.removeRetiredSecrets()
+	if err != nil {
+		log.Printf("Janitor failed removing retired keys, %s", err)
+	}
+}
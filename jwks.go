@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"log"
+	"math/big"
+	"net/http"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// One public key in a JWKS (RFC 7517), Ed25519 keys use crv and x, RSA
+// keys use n and e
+type jwk struct {
+	KeyType   string `json:"kty"`
+	ID        string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+type jwksResponse struct {
+	Keys []jwk `json:"keys"`
+}
+
+// The public half of an asymmetric key, false for HMAC keys which can't be
+// shared
+func (k *keyring) publicJWK(key SigningKey) (jwk, bool) {
+	if key.Algorithm == jwt.SigningMethodHS256.Alg() {
+		return jwk{}, false
+	}
+	public, err := k.verifyingKey(key)
+	if err != nil {
+		log.Println(err)
+		return jwk{}, false
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	switch public := public.(type) {
+	case ed25519.PublicKey:
+		return jwk{KeyType: "OKP", ID: key.ID, Use: "sig", Algorithm: key.Algorithm, Curve: "Ed25519", X: encode(public)}, true
+	case *rsa.PublicKey:
+		e := big.NewInt(int64(public.E)).Bytes()
+		return jwk{KeyType: "RSA", ID: key.ID, Use: "sig", Algorithm: key.Algorithm, N: encode(public.N.Bytes()), E: encode(e)}, true
+	}
+	return jwk{}, false
+}
+
+// Public keys for every asymmetric key that can still verify, so other
+// services can check our tokens without the secret
+func (cfg *apiConfig) handlerJWKS(w http.ResponseWriter, r *http.Request) {
+	keys, err := cfg.database.GetSigningKeys()
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := jwksResponse{Keys: []jwk{}}
+	for _, key := range keys {
+		public, ok := cfg.keys.publicJWK(key)
+		if ok {
+			resp.Keys = append(resp.Keys, public)
+		}
+	}
+	// Verifiers cache this, a few minutes is plenty since keys overlap for
+	// much longer than that when rotated
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	jsonResp(w, http.StatusOK, resp)
+}
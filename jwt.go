@@ -5,34 +5,53 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func MakeJWTAccess(userID int, tokenSecret string, expiresIn time.Duration) (string, error) {
-	signingKey := []byte(tokenSecret)
+// Tokens from before iss and aud were set used iss to say what kind they
+// were. They're still accepted until they run out.
+const (
+	legacyAccessIssuer  = "chirpy-access"
+	legacyRefreshIssuer = "chirpy-refresh"
+)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy-access",
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		Subject:   fmt.Sprintf("%d", userID),
-	})
-	return token.SignedString(signingKey)
+// Refresh tokens are only ever sent back to us, so their audience is fixed
+// and keeps them from passing as access tokens
+const refreshAudience = "chirpy-refresh"
+
+// Access token claims, sid is the session (token family) it was issued for
+type accessClaims struct {
+	SessionID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
 }
 
-func MakeJWTRefresh(userID int, tokenSecret string, expiresIn time.Duration) (string, error) {
-	signingKey := []byte(tokenSecret)
+func MakeJWTAccess(userID int, keys *keyring, expiresIn time.Duration, sessionID string) (string, error) {
+	return keys.sign(accessClaims{
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    keys.issuer,
+			Audience:  jwt.ClaimStrings{keys.audience},
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+			Subject:   fmt.Sprintf("%d", userID),
+		},
+	})
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy-refresh",
+// tokenID becomes the jti claim, it's how the DB tracks rotation
+func MakeJWTRefresh(userID int, keys *keyring, expiresIn time.Duration, tokenID string) (string, error) {
+	return keys.sign(jwt.RegisteredClaims{
+		Issuer:    keys.issuer,
+		Audience:  jwt.ClaimStrings{refreshAudience},
 		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
 		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
 		Subject:   fmt.Sprintf("%d", userID),
+		ID:        tokenID,
 	})
-	return token.SignedString(signingKey)
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -48,49 +67,103 @@ func GetBearerToken(headers http.Header) (string, error) {
 	return splitAuth[1], nil
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (string, error) {
-	log.Println("Inside validate access")
-	claimsStruct := jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(
+// Checks the signature and expiry of an access token and returns its claims
+func parseAccessToken(tokenString string, keys *keyring) (*accessClaims, error) {
+	claimsStruct := accessClaims{}
+	_, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		keys.keyFunc,
 	)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	checker, err := token.Claims.GetIssuer()
-	if checker == "chirpy-refresh" {
-		return "", fmt.Errorf("Invalid token in validate. Refresh Token Found")
+	if claimsStruct.Issuer == legacyRefreshIssuer || hasAudience(claimsStruct.RegisteredClaims, refreshAudience) {
+		return nil, fmt.Errorf("Invalid token in validate. Refresh Token Found")
 	}
-	userIDString, err := token.Claims.GetSubject()
-	if err != nil {
-		return "", err
+	if claimsStruct.Issuer != legacyAccessIssuer &&
+		(claimsStruct.Issuer != keys.issuer || !hasAudience(claimsStruct.RegisteredClaims, keys.audience)) {
+		return nil, fmt.Errorf("Invalid token in validate. Wrong issuer or audience")
 	}
-
-	return userIDString, nil
+	return &claimsStruct, nil
 }
 
-func ValidateJWTRefresh(tokenString, tokenSecret string) (string, error) {
-	log.Println("Inside validate refresh")
+// Checks the signature and expiry of a refresh token and returns its claims
+func parseRefreshToken(tokenString string, keys *keyring) (*jwt.RegisteredClaims, error) {
 	claimsStruct := jwt.RegisteredClaims{}
-	token, err := jwt.ParseWithClaims(
+	_, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		keys.keyFunc,
 	)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	checker, err := token.Claims.GetIssuer()
-	if checker != "chirpy-refresh" {
-		return "", fmt.Errorf("Invalid token in validate. Refresh Token Not Found")
+	if claimsStruct.Issuer != legacyRefreshIssuer &&
+		(claimsStruct.Issuer != keys.issuer || !hasAudience(claimsStruct, refreshAudience)) {
+		return nil, fmt.Errorf("Invalid token in validate. Refresh Token Not Found")
 	}
+	return &claimsStruct, nil
+}
+
+func hasAudience(claims jwt.RegisteredClaims, audience string) bool {
+	for _, aud := range claims.Audience {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
 
-	userIDString, err := token.Claims.GetSubject()
+// Pulls the access token off a request and returns the user ID inside it
+func (cfg *apiConfig) getUserID(r *http.Request) (int, error) {
+	_, userID, err := cfg.getSession(r)
+	return userID, err
+}
+
+// Pulls the access token off a request and returns its claims, for handlers
+// that need to know which session is calling
+func (cfg *apiConfig) getSession(r *http.Request) (*accessClaims, int, error) {
+	token, err := GetBearerToken(r.Header)
+	if err != nil {
+		return nil, 0, err
+	}
+	claims, err := cfg.checkAccessToken(token)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Already checked by checkAccessToken
+	userID, _ := strconv.Atoi(claims.Subject)
+	return claims, userID, nil
+}
+
+// Validates an access token and makes sure its session hasn't been logged
+// out, so revoking a session locks out its access tokens straight away
+func (cfg *apiConfig) checkAccessToken(token string) (*accessClaims, error) {
+	claims, err := parseAccessToken(token, cfg.keys)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if _, err := strconv.Atoi(claims.Subject); err != nil {
+		return nil, fmt.Errorf("Invalid user ID in token")
 	}
+	if claims.SessionID != "" {
+		err = cfg.database.CheckSession(claims.SessionID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
 
-	return userIDString, err
+// Like getUserID for endpoints that work logged out, 0 means anonymous
+func (cfg *apiConfig) optionalUserID(r *http.Request) int {
+	if r.Header.Get("Authorization") == "" {
+		return 0
+	}
+	userID, err := cfg.getUserID(r)
+	if err != nil {
+		return 0
+	}
+	return userID
 }
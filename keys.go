@@ -0,0 +1,516 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The key JWT_SECRET provides. Tokens from before the keyring have no kid
+// and are checked against it.
+const envKeyID = "env"
+
+// How long a replaced key keeps verifying. Refresh tokens are the longest
+// lived thing it signed, so by then nothing it signed is still valid.
+const keyRetireGrace = refreshTokenLifetime
+
+// What JWT_ALG can be set to. HS256 needs the key to verify too, the others
+// publish their public keys so anyone can check tokens.
+var signingAlgorithms = map[string]bool{
+	jwt.SigningMethodHS256.Alg(): true,
+	jwt.SigningMethodEdDSA.Alg(): true,
+	jwt.SigningMethodRS256.Alg(): true,
+}
+
+const rsaKeyBits = 2048
+
+var errUnknownKey = errors.New("Token signed with an unknown or retired key")
+
+// A key tokens are signed with. Only the newest signs, older ones verify
+// until RetiresAt. The DB only knows about the key, the secret is in the
+// keyring's directory. The env key's secret comes from JWT_SECRET.
+type SigningKey struct {
+	ID        string `json:"id"`
+	Algorithm string `json:"algorithm"`
+	// DBs from before secrets moved out still have them here, the keyring
+	// moves them to files at startup
+	Secret    []byte     `json:"secret,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiresAt *time.Time `json:"retires_at,omitempty"`
+}
+
+type signingKeyResponse struct {
+	ID        string     `json:"kid"`
+	Algorithm string     `json:"alg"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiresAt *time.Time `json:"retires_at,omitempty"`
+	Current   bool       `json:"current"`
+}
+
+func (k SigningKey) retired(now time.Time) bool {
+	return k.RetiresAt != nil && !now.Before(*k.RetiresAt)
+}
+
+func (m *MemoryDB) applySigningKey(e walEntry) {
+	if e.Op == opClearKeySecrets {
+		for id, key := range m.chirps.SigningKeys {
+			key.Secret = nil
+			m.chirps.SigningKeys[id] = key
+		}
+		return
+	}
+	old, ok := m.chirps.SigningKeys[e.Value]
+	if !ok {
+		// The env key is only written down once it's replaced
+		old = SigningKey{ID: e.Value, Algorithm: jwt.SigningMethodHS256.Alg()}
+	}
+	if old.RetiresAt == nil {
+		old.RetiresAt = e.ExpiresAt
+	}
+	m.chirps.SigningKeys[old.ID] = old
+	m.chirps.SigningKeys[e.SigningKey.ID] = *e.SigningKey
+}
+
+// Callers must hold mux
+func (m *MemoryDB) currentSigningKey() SigningKey {
+	for _, key := range m.chirps.SigningKeys {
+		if key.RetiresAt == nil {
+			return key
+		}
+	}
+	return SigningKey{ID: envKeyID, Algorithm: jwt.SigningMethodHS256.Alg()}
+}
+
+// The key new tokens are signed with
+func (m *MemoryDB) CurrentSigningKey() (SigningKey, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	return m.currentSigningKey(), nil
+}
+
+// Looks up a key that can still verify tokens
+func (m *MemoryDB) GetSigningKey(id string) (SigningKey, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	key, ok := m.chirps.SigningKeys[id]
+	if !ok {
+		if id != envKeyID {
+			return SigningKey{}, errUnknownKey
+		}
+		key = m.currentSigningKey()
+		if key.ID != envKeyID {
+			return SigningKey{}, errUnknownKey
+		}
+	}
+	if key.retired(time.Now().UTC()) {
+		return SigningKey{}, errUnknownKey
+	}
+	return key, nil
+}
+
+// Every key that can still verify, newest first
+func (m *MemoryDB) GetSigningKeys() ([]SigningKey, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	now := time.Now().UTC()
+	keys := []SigningKey{}
+	if _, ok := m.chirps.SigningKeys[envKeyID]; !ok {
+		keys = append(keys, m.currentSigningKey())
+	}
+	for _, key := range m.chirps.SigningKeys {
+		if !key.retired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+// Makes a key and its secret, the HMAC key for HS256 and the PKCS #8
+// private key otherwise
+func newSigningKey(alg string) (SigningKey, []byte, error) {
+	id, err := randomID()
+	if err != nil {
+		return SigningKey{}, nil, err
+	}
+	var secret []byte
+	switch alg {
+	case jwt.SigningMethodHS256.Alg():
+		secret = make([]byte, 32)
+		_, err = rand.Read(secret)
+	case jwt.SigningMethodEdDSA.Alg():
+		var private ed25519.PrivateKey
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+		if err == nil {
+			secret, err = x509.MarshalPKCS8PrivateKey(private)
+		}
+	case jwt.SigningMethodRS256.Alg():
+		var private *rsa.PrivateKey
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err == nil {
+			secret, err = x509.MarshalPKCS8PrivateKey(private)
+		}
+	default:
+		return SigningKey{}, nil, fmt.Errorf("Unsupported signing algorithm %q", alg)
+	}
+	if err != nil {
+		return SigningKey{}, nil, fmt.Errorf("Error generating key, %s", err)
+	}
+	return SigningKey{
+		ID:        id,
+		Algorithm: alg,
+		CreatedAt: time.Now().UTC(),
+	}, secret, nil
+}
+
+// Makes key the one that signs, its secret must already be saved. The old
+// one keeps verifying for keyRetireGrace so nobody gets logged out.
+func (m *MemoryDB) RotateSigningKey(key SigningKey) error {
+	key.Secret = nil
+	retiresAt := key.CreatedAt.Add(keyRetireGrace)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	old := m.currentSigningKey()
+	return m.commit(walEntry{Op: opRotateSigningKey, SigningKey: &key, Value: old.ID, ExpiresAt: &retiresAt, Time: key.CreatedAt})
+}
+
+// Drops secrets left over from before they moved to files, returns how many
+// keys had one
+func (m *MemoryDB) clearSigningKeySecrets() (int, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	cleared := 0
+	for _, key := range m.chirps.SigningKeys {
+		if key.Secret != nil {
+			cleared++
+		}
+	}
+	if cleared == 0 {
+		return 0, nil
+	}
+	return cleared, m.commit(walEntry{Op: opClearKeySecrets})
+}
+
+// The snapshot and log still have the secrets in them until they're
+// rewritten, so that's done straight away
+func (db *DB) clearSigningKeySecrets() (int, error) {
+	cleared, err := db.MemoryDB.clearSigningKeySecrets()
+	if err != nil || cleared == 0 {
+		return cleared, err
+	}
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return cleared, db.compact()
+}
+
+// Signs and checks tokens with the keys in the DB, JWT_SECRET backs the env
+// key. Also holds what tokens are issued as.
+type keyring struct {
+	db Store
+	// Where the secrets are, one <kid>.key file each. Kept apart from the DB
+	// so nothing that copies or serves it gives keys away.
+	dir       string
+	envSecret []byte
+	// What new keys use, from JWT_ALG
+	algorithm string
+	issuer    string
+	audience  string
+
+	// Held while key files are written or removed, and for secrets
+	mux sync.Mutex
+	// Secrets by kid, private keys decoded since RSA ones are slow to parse
+	secrets map[string]interface{}
+}
+
+func newKeyring(db Store, dir, envSecret, algorithm, issuer, audience string) (*keyring, error) {
+	if !signingAlgorithms[algorithm] {
+		return nil, fmt.Errorf("Unsupported signing algorithm %q", algorithm)
+	}
+	return &keyring{
+		db:        db,
+		dir:       dir,
+		envSecret: []byte(envSecret),
+		algorithm: algorithm,
+		issuer:    issuer,
+		audience:  audience,
+		secrets:   map[string]interface{}{},
+	}, nil
+}
+
+func (k *keyring) secretPath(id string) string {
+	return filepath.Join(k.dir, id+".key")
+}
+
+// Callers must hold mux
+func (k *keyring) saveSecret(id string, secret []byte) error {
+	err := os.MkdirAll(k.dir, 0700)
+	if err != nil {
+		return fmt.Errorf("Error creating key directory, %s", err)
+	}
+	err = writeFileAtomic(k.secretPath(id), secret, 0600)
+	if err != nil {
+		return fmt.Errorf("Error saving signing key %s, %s", id, err)
+	}
+	return nil
+}
+
+// Makes a new key of the configured algorithm the one that signs
+func (k *keyring) rotate() (SigningKey, error) {
+	// RSA keys take a moment, so make it before locking
+	key, secret, err := newSigningKey(k.algorithm)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	err = k.saveSecret(key.ID, secret)
+	if err != nil {
+		return SigningKey{}, err
+	}
+	err = k.db.RotateSigningKey(key)
+	if err != nil {
+		os.Remove(k.secretPath(key.ID))
+		return SigningKey{}, err
+	}
+	return key, nil
+}
+
+// Moves secrets out of DBs from before they were kept in files. A file
+// that's already there wins, it's what the key has been signing with.
+func (k *keyring) migrateSecrets() error {
+	keys, err := k.db.GetSigningKeys()
+	if err != nil {
+		return err
+	}
+	k.mux.Lock()
+	for _, key := range keys {
+		if key.Secret == nil {
+			continue
+		}
+		_, err = os.Stat(k.secretPath(key.ID))
+		if err == nil {
+			continue
+		}
+		err = k.saveSecret(key.ID, key.Secret)
+		if err != nil {
+			k.mux.Unlock()
+			return err
+		}
+	}
+	k.mux.Unlock()
+	cleared, err := k.db.clearSigningKeySecrets()
+	if err != nil {
+		return err
+	}
+	if cleared > 0 {
+		log.Printf("Moved signing key secrets out of the database into %s", k.dir)
+	}
+	return nil
+}
+
+// Rotates to a new key if the current one isn't the configured algorithm,
+// so changing JWT_ALG doesn't log anyone out. Also rotates if the current
+// key's secret has gone missing, nothing could be signed otherwise.
+func (k *keyring) ensureAlgorithm() error {
+	current, err := k.db.CurrentSigningKey()
+	if err != nil {
+		return err
+	}
+	_, err = k.signingKey(current)
+	if err != nil {
+		log.Printf("Can't sign with key %s, rotating to a new one, %s", current.ID, err)
+	} else if current.Algorithm == k.algorithm {
+		return nil
+	}
+	key, err := k.rotate()
+	if err != nil {
+		return err
+	}
+	log.Printf("Switched signing from %s to %s, now signing with %s", current.Algorithm, key.Algorithm, key.ID)
+	return nil
+}
+
+// Deletes the files of keys that no longer verify anything, run by the
+// janitor
+func (k *keyring) removeRetiredSecrets() error {
+	entries, err := os.ReadDir(k.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	removed := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".key")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		_, err := k.db.GetSigningKey(id)
+		if !errors.Is(err, errUnknownKey) {
+			continue
+		}
+		err = os.Remove(k.secretPath(id))
+		if err != nil {
+			return err
+		}
+		delete(k.secrets, id)
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Removed %d retired signing keys", removed)
+	}
+	return nil
+}
+
+// What to sign with, the HMAC secret or the decoded private key
+func (k *keyring) signingKey(key SigningKey) (interface{}, error) {
+	if key.ID == envKeyID {
+		return k.envSecret, nil
+	}
+	k.mux.Lock()
+	defer k.mux.Unlock()
+	secret, ok := k.secrets[key.ID]
+	if ok {
+		return secret, nil
+	}
+	data, err := os.ReadFile(k.secretPath(key.ID))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading signing key %s, %s", key.ID, err)
+	}
+	secret = data
+	if key.Algorithm != jwt.SigningMethodHS256.Alg() {
+		secret, err = x509.ParsePKCS8PrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading signing key %s, %s", key.ID, err)
+		}
+	}
+	k.secrets[key.ID] = secret
+	return secret, nil
+}
+
+// What to verify with, the HMAC secret or the public half of the key
+func (k *keyring) verifyingKey(key SigningKey) (interface{}, error) {
+	signing, err := k.signingKey(key)
+	if err != nil {
+		return nil, err
+	}
+	switch private := signing.(type) {
+	case ed25519.PrivateKey:
+		return private.Public(), nil
+	case *rsa.PrivateKey:
+		return &private.PublicKey, nil
+	}
+	return signing, nil
+}
+
+// Signs claims with the current key and puts its ID in the kid header
+func (k *keyring) sign(claims jwt.Claims) (string, error) {
+	key, err := k.db.CurrentSigningKey()
+	if err != nil {
+		return "", err
+	}
+	signing, err := k.signingKey(key)
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(signing)
+}
+
+// Picks the key a token says it was signed with, for jwt.ParseWithClaims
+func (k *keyring) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = envKeyID
+	}
+	key, err := k.db.GetSigningKey(kid)
+	if err != nil {
+		return nil, err
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("Token algorithm doesn't match its key")
+	}
+	return k.verifyingKey(key)
+}
+
+// Admin endpoints need ADMIN_KEY as a bearer token, and are off without it
+func (cfg *apiConfig) checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if cfg.AdminKey == "" {
+		errorResp(w, http.StatusForbidden, "Admin API is disabled")
+		return false
+	}
+	key, err := GetBearerToken(r.Header)
+	if err != nil || subtle.ConstantTimeCompare([]byte(key), []byte(cfg.AdminKey)) != 1 {
+		errorResp(w, http.StatusUnauthorized, "Invalid admin key")
+		return false
+	}
+	return true
+}
+
+func newSigningKeyResponses(keys []SigningKey, currentID string) []signingKeyResponse {
+	resp := make([]signingKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		resp = append(resp, signingKeyResponse{
+			ID:        key.ID,
+			Algorithm: key.Algorithm,
+			CreatedAt: key.CreatedAt,
+			RetiresAt: key.RetiresAt,
+			Current:   key.ID == currentID,
+		})
+	}
+	return resp
+}
+
+// Lists the keys that can still verify tokens, never their secrets
+func (cfg *apiConfig) handlerGetSigningKeys(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Get Signing Keys")
+	if !cfg.checkAdmin(w, r) {
+		return
+	}
+	keys, err := cfg.database.GetSigningKeys()
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	current, err := cfg.database.CurrentSigningKey()
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	jsonResp(w, http.StatusOK, newSigningKeyResponses(keys, current.ID))
+}
+
+// Starts signing with a new key, tokens signed by the old one stay valid
+func (cfg *apiConfig) handlerRotateSigningKey(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Rotate Signing Key")
+	if !cfg.checkAdmin(w, r) {
+		return
+	}
+	key, err := cfg.keys.rotate()
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("Rotated signing key, now signing with %s", key.ID)
+	jsonResp(w, http.StatusCreated, newSigningKeyResponses([]SigningKey{key}, key.ID)[0])
+}
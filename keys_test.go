@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func newTestKeyring(t *testing.T, db Store, dir, alg string) *keyring {
+	t.Helper()
+	keys, err := newKeyring(db, dir, "test-secret", alg, "chirpy", "chirpy-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// Fails if anything the DB writes to disk holds key material
+func checkNoSecretsOnDisk(t *testing.T, path string, secret []byte) {
+	t.Helper()
+	for _, file := range []string{path, walPath(path)} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte(`"secret"`)) {
+			t.Errorf("Expected no secrets in %s, got %s", file, data)
+		}
+		if secret != nil && bytes.Contains(data, secret) {
+			t.Errorf("Expected the key not to be in %s", file)
+		}
+	}
+}
+
+func checkSignAndVerify(t *testing.T, keys *keyring) {
+	t.Helper()
+	token, err := MakeJWTAccess(1, keys, time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = parseAccessToken(token, keys)
+	if err != nil {
+		t.Errorf("Expected the token to verify, got %s", err)
+	}
+}
+
+// Rotated keys go to files only this user can read, the DB only gets told
+// the key exists
+func TestRotatedKeysStayOutOfTheDB(t *testing.T) {
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "database.json")
+	dir := filepath.Join(tmp, "keys")
+	// The env key is HS256 already, so that goes last to get a key of its own
+	for _, alg := range []string{"EdDSA", "RS256", "HS256"} {
+		db := openTestDB(t, path)
+		keys := newTestKeyring(t, db, dir, alg)
+		err := keys.ensureAlgorithm()
+		if err != nil {
+			t.Fatal(err)
+		}
+		current, _ := db.CurrentSigningKey()
+		if current.Algorithm != alg {
+			t.Fatalf("Expected to sign with %s, got %s", alg, current.Algorithm)
+		}
+		info, err := os.Stat(keys.secretPath(current.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("Expected the key file to be 0600, got %o", info.Mode().Perm())
+		}
+		secret, _ := os.ReadFile(keys.secretPath(current.ID))
+		checkNoSecretsOnDisk(t, path, secret)
+		checkSignAndVerify(t, keys)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("Expected the key directory to be 0700, got %o", info.Mode().Perm())
+	}
+}
+
+// Keys from a DB that still has its secrets move to files, and tokens they
+// signed keep working
+func TestMigrateSecretsOutOfTheDB(t *testing.T) {
+	tmp := t.TempDir()
+	path := filepath.Join(tmp, "database.json")
+	db := openTestDB(t, path)
+	key, secret, err := newSigningKey("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// How rotations used to be written
+	key.Secret = secret
+	retiresAt := key.CreatedAt.Add(keyRetireGrace)
+	db.mux.Lock()
+	err = db.commit(walEntry{Op: opRotateSigningKey, SigningKey: &key, Value: envKeyID, ExpiresAt: &retiresAt})
+	db.mux.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Somewhere else to sign a token with the key from before the move
+	old := newTestKeyring(t, db, t.TempDir(), "EdDSA")
+	err = os.WriteFile(old.secretPath(key.ID), secret, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := MakeJWTAccess(1, old, time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openTestDB(t, path)
+	keys := newTestKeyring(t, reopened, filepath.Join(tmp, "keys"), "EdDSA")
+	err = keys.migrateSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(keys.secretPath(key.ID))
+	if err != nil || !bytes.Equal(saved, secret) {
+		t.Fatalf("Expected the secret to be moved to its file, got %v", err)
+	}
+	checkNoSecretsOnDisk(t, path, secret)
+	_, err = parseAccessToken(token, keys)
+	if err != nil {
+		t.Errorf("Expected a token signed before the move to verify, got %s", err)
+	}
+	err = keys.ensureAlgorithm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ := reopened.CurrentSigningKey()
+	if current.ID != key.ID {
+		t.Errorf("Expected to keep signing with %s, got %s", key.ID, current.ID)
+	}
+}
+
+// Without the current key's file nothing could be signed, so a new key
+// takes over
+func TestMissingKeyFileRotates(t *testing.T) {
+	db := NewMemoryDB()
+	keys := newTestKeyring(t, db, t.TempDir(), "HS256")
+	key, err := keys.rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Remove(keys.secretPath(key.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = newTestKeyring(t, db, keys.dir, "HS256")
+	err = keys.ensureAlgorithm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ := db.CurrentSigningKey()
+	if current.ID == key.ID {
+		t.Fatal("Expected a new key")
+	}
+	checkSignAndVerify(t, keys)
+}
+
+func TestRemoveRetiredSecrets(t *testing.T) {
+	db := NewMemoryDB()
+	keys := newTestKeyring(t, db, t.TempDir(), "EdDSA")
+	old, err := keys.rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := keys.rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file no key knows about, say from a DB that was reset
+	err = os.WriteFile(keys.secretPath("stray"), []byte("x"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.mux.Lock()
+	retired := db.chirps.SigningKeys[old.ID]
+	retiredAt := time.Now().UTC().Add(-time.Minute)
+	retired.RetiresAt = &retiredAt
+	db.chirps.SigningKeys[old.ID] = retired
+	db.mux.Unlock()
+
+	err = keys.removeRetiredSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(keys.dir)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, ",") != current.ID+".key" {
+		t.Errorf("Expected only the current key's file to be left, got %v", names)
+	}
+	checkSignAndVerify(t, keys)
+}
+
+// The JWKS has the public half of every asymmetric key that still verifies
+func TestJWKSListsPublicKeys(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	api.cfg.keys.algorithm = jwt.SigningMethodEdDSA.Alg()
+	first, err := api.cfg.keys.rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := api.cfg.keys.rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := jwksResponse{}
+	api.do("GET", "/.well-known/jwks.json", "", nil, &resp)
+	kids := map[string]bool{}
+	for _, key := range resp.Keys {
+		kids[key.ID] = true
+		if key.KeyType != "OKP" || key.X == "" {
+			t.Errorf("Expected an Ed25519 public key, got %+v", key)
+		}
+	}
+	if len(resp.Keys) != 2 || !kids[first.ID] || !kids[second.ID] {
+		t.Errorf("Expected keys %s and %s, got %+v", first.ID, second.ID, resp.Keys)
+	}
+}
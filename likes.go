@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// What a plain like is stored as, everything else is an emoji reaction
+const reactionLike = "like"
+
+var allowedReactions = map[string]struct{}{
+	reactionLike: {},
+	"❤️":         {},
+	"😂":          {},
+	"😮":          {},
+	"😢":          {},
+	"🔥":          {},
+	"👍":          {},
+}
+
+var errInvalidReaction = errors.New("Reaction not allowed")
+
+// Totals for one chirp as seen by one viewer
+type LikeSummary struct {
+	Count     int
+	Reactions map[string]int
+	// The viewer's own reaction, empty if they haven't reacted
+	Mine string
+}
+
+type Like struct {
+	UserID   int    `json:"user_id"`
+	Reaction string `json:"reaction"`
+}
+
+func (m *MemoryDB) applyLike(e walEntry) {
+	if e.Op == opUnlike {
+		delete(m.chirps.Likes[e.ID], e.UserID)
+		if len(m.chirps.Likes[e.ID]) == 0 {
+			delete(m.chirps.Likes, e.ID)
+		}
+		return
+	}
+	if m.chirps.Likes[e.ID] == nil {
+		m.chirps.Likes[e.ID] = map[int]string{}
+	}
+	m.chirps.Likes[e.ID][e.UserID] = e.Value
+}
+
+// Each user gets one reaction per chirp, liking again just changes it
+func (m *MemoryDB) LikeChirp(chirpID, userID int, reaction string) error {
+	if reaction == "" {
+		reaction = reactionLike
+	}
+	if _, ok := allowedReactions[reaction]; !ok {
+		return errInvalidReaction
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	chirp, ok := m.chirps.Chirps[chirpID]
+	if !ok || chirp.DeletedAt != nil {
+		return errChirpNotFound
+	}
+	previous, liked := m.chirps.Likes[chirpID][userID]
+	if previous == reaction {
+		return nil
+	}
+	err := m.commit(walEntry{Op: opLike, ID: chirpID, UserID: userID, Value: reaction})
+	if err != nil {
+		return err
+	}
+	// Only the first reaction is news, switching emoji isn't
+	if liked || chirp.Author == userID {
+		return nil
+	}
+	return m.notify(Notification{
+		UserID:  chirp.Author,
+		Type:    notificationLike,
+		ActorID: userID,
+		ChirpID: chirpID,
+	})
+}
+
+func (m *MemoryDB) UnlikeChirp(chirpID, userID int) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if _, ok := m.chirps.Likes[chirpID][userID]; !ok {
+		return nil
+	}
+	return m.commit(walEntry{Op: opUnlike, ID: chirpID, UserID: userID})
+}
+
+func (m *MemoryDB) GetLikes(chirpID int) ([]Like, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	chirp, ok := m.chirps.Chirps[chirpID]
+	if !ok || chirp.DeletedAt != nil {
+		return nil, errChirpNotFound
+	}
+	likes := make([]Like, 0, len(m.chirps.Likes[chirpID]))
+	for userID, reaction := range m.chirps.Likes[chirpID] {
+		likes = append(likes, Like{
+			UserID:   userID,
+			Reaction: reaction,
+		})
+	}
+	sort.Slice(likes, func(i, j int) bool {
+		return likes[i].UserID < likes[j].UserID
+	})
+	return likes, nil
+}
+
+// Like totals for a batch of chirps, viewerID 0 means nobody's logged in
+func (m *MemoryDB) GetLikeSummaries(chirpIDs []int, viewerID int) (map[int]LikeSummary, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	summaries := make(map[int]LikeSummary, len(chirpIDs))
+	for _, id := range chirpIDs {
+		likes := m.chirps.Likes[id]
+		summary := LikeSummary{
+			Count:     len(likes),
+			Reactions: map[string]int{},
+		}
+		for userID, reaction := range likes {
+			summary.Reactions[reaction]++
+			if userID == viewerID {
+				summary.Mine = reaction
+			}
+		}
+		summaries[id] = summary
+	}
+	return summaries, nil
+}
+
+// Fills in like counts and the viewer's own reaction on each chirp
+func (cfg *apiConfig) addLikes(chirps []chirpsResponse, viewerID int) {
+	ids := make([]int, 0, len(chirps))
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.ID)
+	}
+	summaries, err := cfg.database.GetLikeSummaries(ids, viewerID)
+	if err != nil {
+		log.Printf("Error getting likes, %s", err)
+		return
+	}
+	for i := range chirps {
+		summary := summaries[chirps[i].ID]
+		chirps[i].LikeCount = summary.Count
+		chirps[i].Reactions = summary.Reactions
+		chirps[i].LikedByMe = summary.Mine != ""
+		chirps[i].MyReaction = summary.Mine
+	}
+}
+
+// Likes or reacts to a chirp, body is optional: {"reaction": "🔥"}
+func (cfg *apiConfig) handlerLikeChirp(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Like Chirp")
+	type likeRequest struct {
+		Reaction string `json:"reaction"`
+	}
+	userID, err := cfg.getUserID(r)
+	if err != nil {
+		errorResp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, "Error getting ID")
+		return
+	}
+	checker := likeRequest{}
+	if r.ContentLength != 0 {
+		err = json.NewDecoder(r.Body).Decode(&checker)
+		if err != nil {
+			errorResp(w, http.StatusBadRequest, "Couldn't decode parameters")
+			return
+		}
+	}
+
+	err = cfg.database.LikeChirp(chirpID, userID, checker.Reaction)
+	if errors.Is(err, errInvalidReaction) {
+		errorResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, errChirpNotFound) {
+		errorResp(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerUnlikeChirp(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Unlike Chirp")
+	userID, err := cfg.getUserID(r)
+	if err != nil {
+		errorResp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, "Error getting ID")
+		return
+	}
+	err = cfg.database.UnlikeChirp(chirpID, userID)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Who liked a chirp and how
+func (cfg *apiConfig) handlerGetLikes(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, "Error getting ID")
+		return
+	}
+	likes, err := cfg.database.GetLikes(chirpID)
+	if err != nil {
+		errorResp(w, http.StatusNotFound, err.Error())
+		return
+	}
+	jsonResp(w, http.StatusOK, likes)
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	// Server pings this often, a client that doesn't answer within
+	// livePongTimeout is assumed gone
+	livePingEvery   = 30 * time.Second
+	livePongTimeout = 45 * time.Second
+	// How long a single write may take before the client counts as gone
+	liveWriteTimeout = 10 * time.Second
+	// Biggest message a client may send
+	liveMaxMessage = 64 * 1024
+	// How long before the token runs out the client is asked for a new one
+	liveExpiryWarning = time.Minute
+	liveMaxHashtags   = 50
+	// How often a live connection checks its session is still logged in,
+	// unless apiConfig.liveSessionCheckEvery says otherwise
+	liveSessionCheckEvery = 15 * time.Second
+)
+
+// Close codes of our own, 4000-4999 are free for applications
+const (
+	liveCloseTokenExpired   websocket.StatusCode = 4001
+	liveCloseSessionRevoked websocket.StatusCode = 4003
+)
+
+// Channels a live connection can subscribe to
+const (
+	channelTimeline      = "timeline"
+	channelHashtag       = "hashtag"
+	channelNotifications = "notifications"
+)
+
+// What clients send:
+//
+//	{"type": "subscribe", "channel": "timeline"}
+//	{"type": "subscribe", "channel": "hashtag", "tag": "golang"}
+//	{"type": "unsubscribe", "channel": "notifications"}
+//	{"type": "auth", "token": "<new access token>"}
+type liveRequest struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel"`
+	Tag     string `json:"tag"`
+	Token   string `json:"token"`
+}
+
+// What the server sends back, type is one of subscribed, unsubscribed,
+// authenticated, event, reauth_required or error
+type liveMessage struct {
+	Type      string      `json:"type"`
+	Channel   string      `json:"channel,omitempty"`
+	Tag       string      `json:"tag,omitempty"`
+	Event     string      `json:"event,omitempty"`
+	ID        int64       `json:"id,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// One client connection and what it's subscribed to
+type liveSession struct {
+	cfg    *apiConfig
+	conn   *websocket.Conn
+	userID int
+	// The login the token belongs to, empty for tokens from before sessions
+	sessionID string
+	expiresAt time.Time
+	// Fire liveExpiryWarning before and at expiresAt
+	warnTimer   *time.Timer
+	expireTimer *time.Timer
+
+	timeline      bool
+	notifications bool
+	hashtags      map[string]bool
+}
+
+// WebSocket for live timeline, hashtag and notification events. Needs an
+// access token, in the Authorization header or ?access_token= for browsers
+// that can't set headers. Before it expires the client gets reauth_required
+// and can send a fresh one with an auth message, otherwise the socket is
+// closed with 4001. Logging the session out closes it with 4003. A client
+// that can't keep up is closed with 1013.
+func (cfg *apiConfig) handlerLive(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Live")
+	token, err := GetBearerToken(r.Header)
+	if err != nil {
+		token = r.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		errorResp(w, http.StatusUnauthorized, "No auth included")
+		return
+	}
+	claims, err := cfg.authenticateLive(token)
+	if err != nil {
+		errorResp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	// The token is the only credential, there's no cookie for another site
+	// to ride on, so any origin may connect
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{InsecureSkipVerify: true})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer conn.CloseNow()
+	conn.SetReadLimit(liveMaxMessage)
+
+	s := &liveSession{
+		cfg:         cfg,
+		conn:        conn,
+		userID:      claims.userID,
+		sessionID:   claims.SessionID,
+		warnTimer:   time.NewTimer(0),
+		expireTimer: time.NewTimer(0),
+		hashtags:    map[string]bool{},
+	}
+	s.setExpiry(claims.ExpiresAt.Time)
+	defer s.warnTimer.Stop()
+	defer s.expireTimer.Stop()
+	err = s.run()
+	if err != nil {
+		log.Printf("Live connection for user %d ended, %s", s.userID, err)
+	}
+}
+
+// An access token's claims with the user ID already parsed
+type liveClaims struct {
+	*accessClaims
+	userID int
+}
+
+// Checks an access token, the claims say who it's for, which session it
+// belongs to and when it runs out
+func (cfg *apiConfig) authenticateLive(token string) (liveClaims, error) {
+	claims, err := cfg.checkAccessToken(token)
+	if err != nil {
+		return liveClaims{}, err
+	}
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return liveClaims{}, fmt.Errorf("Invalid user ID in token")
+	}
+	if claims.ExpiresAt == nil {
+		return liveClaims{}, fmt.Errorf("Token has no expiry")
+	}
+	return liveClaims{accessClaims: claims, userID: userID}, nil
+}
+
+// Closes the socket with 4003 if the session has been logged out since the
+// token was checked. Returns whether it's still open.
+func (s *liveSession) checkSession() bool {
+	if s.sessionID == "" {
+		return true
+	}
+	err := s.cfg.database.CheckSession(s.sessionID)
+	if err == nil {
+		return true
+	}
+	s.conn.Close(liveCloseSessionRevoked, err.Error())
+	return false
+}
+
+type liveFrame struct {
+	typ     websocket.MessageType
+	payload []byte
+}
+
+func (s *liveSession) run() error {
+	bus := s.cfg.database.Events()
+	sub, _ := bus.subscribe(0)
+	defer bus.unsubscribe(sub)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The library answers pings and closes while a read is waiting, the
+	// reader just hands messages over
+	frames := make(chan liveFrame)
+	// Room for the reader and the pinger to both fail
+	readErr := make(chan error, 2)
+	go func() {
+		for {
+			typ, payload, err := s.conn.Read(ctx)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case frames <- liveFrame{typ, payload}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		ping := time.NewTicker(livePingEvery)
+		defer ping.Stop()
+		for {
+			select {
+			case <-ping.C:
+			case <-ctx.Done():
+				return
+			}
+			pingCtx, cancelPing := context.WithTimeout(ctx, livePongTimeout)
+			err := s.conn.Ping(pingCtx)
+			cancelPing()
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	checkEvery := s.cfg.liveSessionCheckEvery
+	if checkEvery == 0 {
+		checkEvery = liveSessionCheckEvery
+	}
+	sessionCheck := time.NewTicker(checkEvery)
+	defer sessionCheck.Stop()
+	for {
+		var err error
+		select {
+		case err = <-readErr:
+			// The library has already answered a close or a protocol error
+			if websocket.CloseStatus(err) != -1 || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		case frame := <-frames:
+			if frame.typ != websocket.MessageText {
+				s.conn.Close(websocket.StatusUnsupportedData, "Only text messages are supported")
+				return nil
+			}
+			// The library leaves checking text is UTF-8 to us
+			if !utf8.Valid(frame.payload) {
+				s.conn.Close(websocket.StatusInvalidFramePayloadData, "Text messages must be UTF-8")
+				return nil
+			}
+			err = s.handleRequest(frame.payload)
+		case e, ok := <-sub.events:
+			if !ok {
+				s.conn.Close(websocket.StatusTryAgainLater, "Too far behind, reconnect")
+				return fmt.Errorf("Too slow to keep up")
+			}
+			// Nothing more goes out once the session's logged out
+			if !s.checkSession() {
+				return nil
+			}
+			err = s.deliver(e)
+		case <-sessionCheck.C:
+			if !s.checkSession() {
+				return nil
+			}
+		case <-s.warnTimer.C:
+			expiresAt := s.expiresAt
+			err = s.send(liveMessage{Type: "reauth_required", ExpiresAt: &expiresAt})
+		case <-s.expireTimer.C:
+			s.conn.Close(liveCloseTokenExpired, "Token expired")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Points both timers at a new expiry time
+func (s *liveSession) setExpiry(expiresAt time.Time) {
+	s.expiresAt = expiresAt
+	resetTimer(s.warnTimer, time.Until(expiresAt.Add(-liveExpiryWarning)))
+	resetTimer(s.expireTimer, time.Until(expiresAt))
+}
+
+// Stops t, drains it if it already fired and starts it again
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+	t.Reset(d)
+}
+
+func (s *liveSession) send(msg liveMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), liveWriteTimeout)
+	defer cancel()
+	return s.conn.Write(ctx, websocket.MessageText, data)
+}
+
+// Mistakes in a request are reported back, they don't close the socket
+func (s *liveSession) handleRequest(payload []byte) error {
+	req := liveRequest{}
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return s.send(liveMessage{Type: "error", Error: "Couldn't decode message"})
+	}
+	tag := strings.ToLower(strings.TrimPrefix(req.Tag, "#"))
+
+	switch req.Type {
+	case "subscribe", "unsubscribe":
+		on := req.Type == "subscribe"
+		switch req.Channel {
+		case channelTimeline:
+			s.timeline = on
+		case channelNotifications:
+			s.notifications = on
+		case channelHashtag:
+			if tag == "" {
+				return s.send(liveMessage{Type: "error", Error: "Hashtag channel needs a tag"})
+			}
+			if !on {
+				delete(s.hashtags, tag)
+				break
+			}
+			if len(s.hashtags) >= liveMaxHashtags && !s.hashtags[tag] {
+				return s.send(liveMessage{Type: "error", Error: "Too many hashtag subscriptions"})
+			}
+			s.hashtags[tag] = true
+		default:
+			return s.send(liveMessage{Type: "error", Error: "Unknown channel"})
+		}
+		if req.Channel != channelHashtag {
+			tag = ""
+		}
+		return s.send(liveMessage{Type: req.Type + "d", Channel: req.Channel, Tag: tag})
+	case "auth":
+		claims, err := s.cfg.authenticateLive(req.Token)
+		if err != nil {
+			return s.send(liveMessage{Type: "error", Error: err.Error()})
+		}
+		if claims.userID != s.userID {
+			s.conn.Close(websocket.StatusPolicyViolation, "Token is for a different user")
+			return fmt.Errorf("Reauthenticated as a different user")
+		}
+		s.sessionID = claims.SessionID
+		expiresAt := claims.ExpiresAt.Time
+		s.setExpiry(expiresAt)
+		return s.send(liveMessage{Type: "authenticated", ExpiresAt: &expiresAt})
+	default:
+		return s.send(liveMessage{Type: "error", Error: "Unknown message type"})
+	}
+}
+
+// Sends e on every subscribed channel it belongs to
+func (s *liveSession) deliver(e Event) error {
+	if e.Type == eventNotification {
+		if !s.notifications || e.Notification.UserID != s.userID {
+			return nil
+		}
+		return s.send(liveMessage{
+			Type:    "event",
+			Channel: channelNotifications,
+			Event:   e.Type,
+			ID:      e.ID,
+			Data:    e.Notification,
+		})
+	}
+	if e.Chirp == nil {
+		return nil
+	}
+
+	var data interface{}
+	payload := func() interface{} {
+		if data != nil {
+			return data
+		}
+		if e.Type == eventChirpDeleted {
+			data = deletedChirpEvent{
+				ID:     e.Chirp.ID,
+				Author: e.Chirp.Author,
+			}
+			return data
+		}
+		resp := []chirpsResponse{newChirpResponse(*e.Chirp)}
+		s.cfg.decorateChirps(resp, s.userID)
+		data = resp[0]
+		return data
+	}
+
+	if s.timeline {
+		following := e.Chirp.Author == s.userID
+		if !following {
+			var err error
+			following, err = s.cfg.database.IsFollowing(s.userID, e.Chirp.Author)
+			if err != nil {
+				return err
+			}
+		}
+		if following {
+			err := s.send(liveMessage{
+				Type:    "event",
+				Channel: channelTimeline,
+				Event:   e.Type,
+				ID:      e.ID,
+				Data:    payload(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, tag := range e.Chirp.Hashtags {
+		if !s.hashtags[tag] {
+			continue
+		}
+		err := s.send(liveMessage{
+			Type:    "event",
+			Channel: channelHashtag,
+			Tag:     tag,
+			Event:   e.Type,
+			ID:      e.ID,
+			Data:    payload(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
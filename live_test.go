@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// The client end of a live socket
+type liveTestClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func dialLive(t *testing.T, api *testAPI, token string) *liveTestClient {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	url := "ws" + strings.TrimPrefix(api.server.URL, "http") + "/api/ws"
+	conn, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": {"Bearer " + token}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseNow() })
+	return &liveTestClient{t: t, conn: conn}
+}
+
+func (c *liveTestClient) send(typ websocket.MessageType, payload []byte) {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := c.conn.Write(ctx, typ, payload)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Sends a request and reads back the next message
+func (c *liveTestClient) request(req liveRequest) liveMessage {
+	c.t.Helper()
+	data, err := json.Marshal(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.send(websocket.MessageText, data)
+	return c.readMessage()
+}
+
+func (c *liveTestClient) read() (websocket.MessageType, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return c.conn.Read(ctx)
+}
+
+func (c *liveTestClient) readMessage() liveMessage {
+	c.t.Helper()
+	typ, payload, err := c.read()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if typ != websocket.MessageText {
+		c.t.Fatalf("Expected a text message, got %s %q", typ, payload)
+	}
+	msg := liveMessage{}
+	err = json.Unmarshal(payload, &msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return msg
+}
+
+// Reads until the server closes and checks the code it closed with
+func (c *liveTestClient) expectClose(code websocket.StatusCode) {
+	c.t.Helper()
+	for {
+		_, payload, err := c.read()
+		if err == nil {
+			continue
+		}
+		got := websocket.CloseStatus(err)
+		if got != code {
+			c.t.Fatalf("Expected close code %d, got %d (%s) after %q", code, got, err, payload)
+		}
+		return
+	}
+}
+
+func TestLiveTimelineEvents(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	login := api.signUp("live@example.com")
+	client := dialLive(t, api, login.Token)
+	msg := client.request(liveRequest{Type: "subscribe", Channel: channelTimeline})
+	if msg.Type != "subscribed" {
+		t.Fatalf("Expected subscribed, got %+v", msg)
+	}
+
+	api.do("POST", "/api/chirps", login.Token, jsonBody{Body: "hello"}, nil)
+	msg = client.readMessage()
+	if msg.Type != "event" || msg.Channel != channelTimeline || msg.Event != eventChirpCreated {
+		t.Errorf("Expected a timeline event, got %+v", msg)
+	}
+}
+
+func TestLiveNeedsUpgrade(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	login := api.signUp("live@example.com")
+	status := api.do("GET", "/api/ws", login.Token, nil, nil)
+	if status != http.StatusUpgradeRequired {
+		t.Errorf("Expected 426 without an upgrade, got %d", status)
+	}
+}
+
+// What a client may send is checked before it gets anywhere near a request
+func TestLiveBadMessages(t *testing.T) {
+	cases := map[string]struct {
+		typ     websocket.MessageType
+		payload []byte
+		code    websocket.StatusCode
+	}{
+		"invalid UTF-8": {websocket.MessageText, []byte("{\"type\": \"\xff\"}"), websocket.StatusInvalidFramePayloadData},
+		"binary":        {websocket.MessageBinary, []byte("{}"), websocket.StatusUnsupportedData},
+		"too big":       {websocket.MessageText, []byte(strings.Repeat("a", liveMaxMessage+1)), websocket.StatusMessageTooBig},
+	}
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			api := newTestAPI(t, NewMemoryDB())
+			client := dialLive(t, api, api.signUp("live@example.com").Token)
+			client.send(c.typ, c.payload)
+			client.expectClose(c.code)
+		})
+	}
+}
+
+// Mistakes in a request only get an error back
+func TestLiveUnknownRequest(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	client := dialLive(t, api, api.signUp("live@example.com").Token)
+	msg := client.request(liveRequest{Type: "subscribe", Channel: "nope"})
+	if msg.Type != "error" {
+		t.Fatalf("Expected an error, got %+v", msg)
+	}
+	msg = client.request(liveRequest{Type: "subscribe", Channel: channelNotifications})
+	if msg.Type != "subscribed" {
+		t.Errorf("Expected the socket to still work, got %+v", msg)
+	}
+}
+
+func TestLiveRejectsRevokedSession(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	login := api.signUp("live@example.com")
+	status := api.do("DELETE", "/api/sessions/"+login.SessionID, login.Token, nil, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("Revoking the session got %d", status)
+	}
+	req, _ := http.NewRequest("GET", api.server.URL+"/api/ws", nil)
+	req.Header.Set("Authorization", "Bearer "+login.Token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 connecting with a revoked session, got %d", resp.StatusCode)
+	}
+}
+
+// Logging out elsewhere closes an open socket before it sends anything else
+func TestLiveClosesOnRevokeBeforeEvent(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	login := api.signUp("live@example.com")
+	other := api.login("live@example.com")
+	client := dialLive(t, api, login.Token)
+	client.request(liveRequest{Type: "subscribe", Channel: channelTimeline})
+
+	status := api.do("DELETE", "/api/sessions/"+login.SessionID, other.Token, nil, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("Revoking the session got %d", status)
+	}
+	api.do("POST", "/api/chirps", other.Token, jsonBody{Body: "hello"}, nil)
+	_, payload, err := client.read()
+	if websocket.CloseStatus(err) != liveCloseSessionRevoked {
+		t.Fatalf("Expected the socket to close with %d instead of sending %q", liveCloseSessionRevoked, payload)
+	}
+}
+
+// With nothing happening the socket still notices the logout
+func TestLiveClosesOnRevokeWhenIdle(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	api.cfg.liveSessionCheckEvery = 20 * time.Millisecond
+	login := api.signUp("live@example.com")
+	client := dialLive(t, api, login.Token)
+	status := api.do("POST", "/api/sessions/revoke-others", api.login("live@example.com").Token, nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("Revoking other sessions got %d", status)
+	}
+	client.expectClose(liveCloseSessionRevoked)
+}
+
+func TestLiveReauthAsSomeoneElse(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	login := api.signUp("live@example.com")
+	other := api.signUp("other@example.com")
+	client := dialLive(t, api, login.Token)
+	data, _ := json.Marshal(liveRequest{Type: "auth", Token: other.Token})
+	client.send(websocket.MessageText, data)
+	client.expectClose(websocket.StatusPolicyViolation)
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/joho/godotenv"
@@ -12,28 +15,101 @@ import (
 func main() {
 	// Create and load DB
 	godotenv.Load()
-	dbPath := "database.json"
-	database, err := NewDB(dbPath)
+	reset := flag.Bool("reset", false, "Wipe the database on startup (dev/test only)")
+	flag.Parse()
+
+	dbPath := os.Getenv("DB_PATH")
+	if dbPath == "" {
+		dbPath = "database.json"
+	}
+	database, err := newStore(os.Getenv("DB_TYPE"), dbPath, *reset)
 	jwtSecret := os.Getenv("JWT_SECRET")
 	polkaKey := os.Getenv("POLKA_KEY")
+	adminKey := os.Getenv("ADMIN_KEY")
 	if err != nil {
 		log.Fatalln(err)
 	}
 
+	// How tokens are signed and who they say they're from and for
+	jwtAlg := os.Getenv("JWT_ALG")
+	if jwtAlg == "" {
+		jwtAlg = "HS256"
+	}
+	jwtIssuer := os.Getenv("JWT_ISSUER")
+	if jwtIssuer == "" {
+		jwtIssuer = "chirpy"
+	}
+	jwtAudience := os.Getenv("JWT_AUDIENCE")
+	if jwtAudience == "" {
+		jwtAudience = "chirpy-api"
+	}
+	// Signing key secrets live outside the database, in a directory only
+	// this user can read
+	keysDir := os.Getenv("KEYS_DIR")
+	if keysDir == "" {
+		keysDir = "keys"
+	}
+	keys, err := newKeyring(database, keysDir, jwtSecret, jwtAlg, jwtIssuer, jwtAudience)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = keys.migrateSecrets()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = keys.ensureAlgorithm()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// /app/media serves uploads, MEDIA_URL can point somewhere else that does
+	mediaDir := os.Getenv("MEDIA_DIR")
+	if mediaDir == "" {
+		mediaDir = "media"
+	}
+	mediaURL := os.Getenv("MEDIA_URL")
+	if mediaURL == "" {
+		mediaURL = "/app/media"
+	}
+
 	cfg := apiConfig{
-		fileserverHits: 0,
-		JWTSecret:      jwtSecret,
-		PolkaKey:       polkaKey,
-		database:       database,
+		keys:     keys,
+		PolkaKey: polkaKey,
+		AdminKey: adminKey,
+		MediaDir: mediaDir,
+		MediaURL: strings.TrimSuffix(mediaURL, "/"),
+		database: database,
 	}
 
+	// Background cleanup
+	go cfg.runJanitor(time.Hour)
+
 	port := "42069"
-	handler := cfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir("."))))
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: cfg.routes(),
+	}
+
+	log.Printf("Serving on port: %s\n", port)
+	log.Fatal(srv.ListenAndServe())
+}
+
+// Every route the server answers, wrapped in CORS. Split out of main so
+// tests can serve it with httptest.
+func (cfg *apiConfig) routes() http.Handler {
+	// Only the front end and uploads are public, serving the working
+	// directory would hand out the database, its WAL and the signing keys
+	appServer := chi.NewRouter()
+	appServer.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "index.html")
+	})
+	appServer.Handle("/assets/*", staticFiles("/app/assets", "assets"))
+	appServer.Handle("/media/*", staticFiles("/app/media", cfg.MediaDir))
 
 	// Main router
 	server := chi.NewRouter()
-	server.Handle("/app", handler)
-	server.Handle("/app/*", handler)
+	server.Mount("/app", cfg.middlewareMetricsInc(appServer))
+	server.Get("/.well-known/jwks.json", cfg.handlerJWKS)
 
 	// API sub-router
 	apiServer := chi.NewRouter()
@@ -41,33 +117,52 @@ func main() {
 	apiServer.Get("/reset", cfg.handlerReset)
 	apiServer.Get("/chirps", cfg.handlerGetChirps)
 	apiServer.Get("/chirps/{id}", cfg.handlerGetChirpByID)
+	apiServer.Get("/chirps/{id}/history", cfg.handlerGetChirpHistory)
+	apiServer.Get("/chirps/{id}/thread", cfg.handlerGetThread)
+	apiServer.Get("/chirps/{id}/likes", cfg.handlerGetLikes)
+	apiServer.Get("/users/{id}", cfg.handlerGetUser)
+	apiServer.Get("/users/by-handle/{handle}", cfg.handlerGetUserByHandle)
+	apiServer.Get("/users/{id}/followers", cfg.handlerGetFollowers)
+	apiServer.Get("/users/{id}/following", cfg.handlerGetFollowing)
+	apiServer.Get("/timeline", cfg.handlerGetTimeline)
+	apiServer.Get("/hashtags/{tag}/chirps", cfg.handlerGetHashtagChirps)
+	apiServer.Get("/trending", cfg.handlerGetTrending)
+	apiServer.Get("/search", cfg.handlerSearch)
+	apiServer.Get("/notifications", cfg.handlerGetNotifications)
+	apiServer.Get("/stream", cfg.handlerStream)
+	apiServer.Get("/ws", cfg.handlerLive)
+	apiServer.Get("/sessions", cfg.handlerGetSessions)
 
 	apiServer.Post("/chirps", cfg.handlerValidateChirp)
+	apiServer.Post("/chirps/{id}/restore", cfg.handlerRestoreChirp)
 	apiServer.Post("/users", cfg.handlerAddUser)
 	apiServer.Post("/login", cfg.handlerLogin)
 	apiServer.Post("/refresh", cfg.handlerRefresh)
 	apiServer.Post("/revoke", cfg.handlerRevoke)
 	apiServer.Post("/polka/webhooks", cfg.handlerUpgradeUser)
+	apiServer.Post("/users/{id}/follow", cfg.handlerFollow)
+	apiServer.Post("/chirps/{id}/likes", cfg.handlerLikeChirp)
+	apiServer.Post("/notifications/read", cfg.handlerReadNotifications)
+	apiServer.Post("/media", cfg.handlerUploadMedia)
+	apiServer.Post("/sessions/revoke-others", cfg.handlerRevokeOtherSessions)
 
 	apiServer.Put("/users", cfg.handlerUpdateUser)
+	apiServer.Put("/chirps/{id}", cfg.handlerEditChirp)
 
 	apiServer.Delete("/chirps/{id}", cfg.handlerDeleteChirpByID)
+	apiServer.Delete("/users/{id}/follow", cfg.handlerUnfollow)
+	apiServer.Delete("/chirps/{id}/likes", cfg.handlerUnlikeChirp)
+	apiServer.Delete("/sessions/{id}", cfg.handlerDeleteSession)
 
 	// Admin sub-router
 	adminServer := chi.NewRouter()
 	adminServer.Get("/metrics", cfg.handlerMetrics)
+	adminServer.Get("/keys", cfg.handlerGetSigningKeys)
+	adminServer.Post("/keys/rotate", cfg.handlerRotateSigningKey)
 
 	// Mounting sub-routers
 	server.Mount("/api", apiServer)
 	server.Mount("/admin", adminServer)
 
-	// Setting CORS & Server Struct
-	corServer := middlewareCors(server)
-	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: corServer,
-	}
-
-	log.Printf("Serving on port: %s\n", port)
-	log.Fatal(srv.ListenAndServe())
+	return middlewareCors(server)
 }
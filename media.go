@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	maxMediaSize = 5 << 20
+	// Anything bigger is refused before it's decoded, so a small file
+	// can't claim enormous dimensions and eat all the memory
+	maxMediaPixels = 40_000_000
+	maxChirpMedia  = 4
+	// How long an upload can wait to be attached before it's thrown away
+	unattachedMediaRetention = 24 * time.Hour
+)
+
+// What uploads can be, keyed by the type sniffed from the file itself
+var mediaExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+var (
+	errMediaNotFound = errors.New("Media does not exist")
+	errMediaInUse    = errors.New("Media is already attached to a chirp")
+	errTooManyMedia  = fmt.Errorf("Chirps can have at most %d attachments", maxChirpMedia)
+)
+
+// An uploaded image, the files live in the media directory
+type Media struct {
+	ID          int       `json:"id"`
+	OwnerID     int       `json:"owner_id"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	File        string    `json:"file"`
+	Thumbnail   string    `json:"thumbnail"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type mediaResponse struct {
+	ID           int    `json:"id"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	ContentType  string `json:"content_type"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+func (m *MemoryDB) applyMedia(e walEntry) {
+	switch e.Op {
+	case opCreateMedia:
+		if e.Media.ID >= m.mediaCount {
+			m.mediaCount = e.Media.ID + 1
+		}
+		m.chirps.Media[e.Media.ID] = *e.Media
+	case opDeleteMedia:
+		for _, id := range e.IDs {
+			delete(m.chirps.Media, id)
+		}
+	}
+}
+
+// Records an upload whose files are already on disk and gives it an ID
+func (m *MemoryDB) CreateMedia(media Media) (Media, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	media.ID = m.mediaCount
+	media.CreatedAt = time.Now().UTC()
+	err := m.commit(walEntry{Op: opCreateMedia, Media: &media, Time: media.CreatedAt})
+	if err != nil {
+		return Media{}, err
+	}
+	return media, nil
+}
+
+// Looks up a batch of media, missing IDs are left out
+func (m *MemoryDB) GetMediaByIDs(ids []int) (map[int]Media, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	media := make(map[int]Media, len(ids))
+	for _, id := range ids {
+		if item, ok := m.chirps.Media[id]; ok {
+			media[id] = item
+		}
+	}
+	return media, nil
+}
+
+// Drops uploads that were never attached to a chirp. Returns them so the
+// caller can remove the files.
+func (m *MemoryDB) pruneUnattachedMedia() ([]Media, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	var ids []int
+	var media []Media
+	for id, item := range m.chirps.Media {
+		if _, ok := m.index.mediaChirps[id]; ok || time.Since(item.CreatedAt) <= unattachedMediaRetention {
+			continue
+		}
+		ids = append(ids, id)
+		media = append(media, item)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	err := m.commit(walEntry{Op: opDeleteMedia, IDs: ids})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Pruned %d unattached uploads", len(ids))
+	return media, nil
+}
+
+// Checks authorID can attach ids to a new chirp, callers must hold mux
+func (m *MemoryDB) checkAttachments(ids []int, authorID int) error {
+	if len(ids) > maxChirpMedia {
+		return errTooManyMedia
+	}
+	seen := map[int]struct{}{}
+	for _, id := range ids {
+		media, ok := m.chirps.Media[id]
+		if !ok || media.OwnerID != authorID {
+			return errMediaNotFound
+		}
+		if _, ok := seen[id]; ok {
+			return errMediaInUse
+		}
+		seen[id] = struct{}{}
+		if _, ok := m.index.mediaChirps[id]; ok {
+			return errMediaInUse
+		}
+	}
+	return nil
+}
+
+// Fills in the attachments on each chirp
+func (cfg *apiConfig) addMedia(chirps []chirpsResponse) {
+	var ids []int
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.MediaIDs...)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	media, err := cfg.database.GetMediaByIDs(ids)
+	if err != nil {
+		log.Printf("Error getting media, %s", err)
+		return
+	}
+	for i := range chirps {
+		for _, id := range chirps[i].MediaIDs {
+			item, ok := media[id]
+			if !ok {
+				continue
+			}
+			chirps[i].Media = append(chirps[i].Media, cfg.newMediaResponse(item))
+		}
+	}
+}
+
+func (cfg *apiConfig) newMediaResponse(media Media) mediaResponse {
+	return mediaResponse{
+		ID:           media.ID,
+		URL:          cfg.MediaURL + "/" + media.File,
+		ThumbnailURL: cfg.MediaURL + "/" + media.Thumbnail,
+		ContentType:  media.ContentType,
+		Width:        media.Width,
+		Height:       media.Height,
+	}
+}
+
+// Uploads an image as multipart form data in the "file" field. The type is
+// worked out from the contents, not whatever the client claims it is.
+func (cfg *apiConfig) handlerUploadMedia(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Upload Media")
+	userID, err := cfg.getUserID(r)
+	if err != nil {
+		errorResp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	// Leave some room for the multipart headers around the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxMediaSize+64<<10)
+	file, _, err := r.FormFile("file")
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		errorResp(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Files can be at most %d bytes", maxMediaSize))
+		return
+	}
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, "Expected an image in the file field")
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxMediaSize+1))
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, "Couldn't read upload")
+		return
+	}
+	if len(data) > maxMediaSize {
+		errorResp(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Files can be at most %d bytes", maxMediaSize))
+		return
+	}
+
+	contentType := http.DetectContentType(data)
+	ext, ok := mediaExtensions[contentType]
+	if !ok {
+		errorResp(w, http.StatusUnsupportedMediaType, "Only JPEG, PNG and GIF images are allowed")
+		return
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, "Couldn't read image")
+		return
+	}
+	if config.Width*config.Height > maxMediaPixels {
+		errorResp(w, http.StatusRequestEntityTooLarge, "Image dimensions are too large")
+		return
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, "Couldn't read image")
+		return
+	}
+
+	// JPEGs stay JPEGs, everything else may have transparency so use PNG
+	thumb := bytes.Buffer{}
+	thumbExt := ".png"
+	if contentType == "image/jpeg" {
+		thumbExt = ".jpg"
+		err = jpeg.Encode(&thumb, makeThumbnail(img, thumbnailSize), &jpeg.Options{Quality: 80})
+	} else {
+		err = png.Encode(&thumb, makeThumbnail(img, thumbnailSize))
+	}
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, "Couldn't make thumbnail")
+		return
+	}
+
+	// Unguessable so uploads can't be found by counting
+	name, err := randomID()
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	media := Media{
+		OwnerID:     userID,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		Width:       config.Width,
+		Height:      config.Height,
+		File:        name + ext,
+		Thumbnail:   name + "_thumb" + thumbExt,
+	}
+	err = cfg.saveMediaFiles(media, data, thumb.Bytes())
+	if err != nil {
+		log.Println(err)
+		errorResp(w, http.StatusInternalServerError, "Couldn't save upload")
+		return
+	}
+	saved, err := cfg.database.CreateMedia(media)
+	if err != nil {
+		cfg.removeMediaFiles(media)
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	jsonResp(w, http.StatusCreated, cfg.newMediaResponse(saved))
+}
+
+func (cfg *apiConfig) saveMediaFiles(media Media, data, thumb []byte) error {
+	err := os.MkdirAll(cfg.MediaDir, 0755)
+	if err != nil {
+		return fmt.Errorf("Error creating media directory, %s", err)
+	}
+	err = writeFileAtomic(filepath.Join(cfg.MediaDir, media.File), data, 0644)
+	if err != nil {
+		return fmt.Errorf("Error writing media, %s", err)
+	}
+	err = writeFileAtomic(filepath.Join(cfg.MediaDir, media.Thumbnail), thumb, 0644)
+	if err != nil {
+		cfg.removeMediaFiles(media)
+		return fmt.Errorf("Error writing thumbnail, %s", err)
+	}
+	return nil
+}
+
+func (cfg *apiConfig) removeMediaFiles(media Media) {
+	for _, name := range []string{media.File, media.Thumbnail} {
+		err := os.Remove(filepath.Join(cfg.MediaDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing media file, %s", err)
+		}
+	}
+}
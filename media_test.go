@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Uploads a tiny PNG and returns what the server made of it
+func (api *testAPI) upload(token string) mediaResponse {
+	api.t.Helper()
+	img := bytes.Buffer{}
+	err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	body := bytes.Buffer{}
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "upload.png")
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	part.Write(img.Bytes())
+	form.Close()
+
+	req, err := http.NewRequest("POST", api.server.URL+"/api/media", &body)
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		api.t.Fatalf("Uploading got %d", resp.StatusCode)
+	}
+	media := mediaResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&media)
+	if err != nil {
+		api.t.Fatal(err)
+	}
+	return media
+}
+
+// Where an upload's original and thumbnail are on disk
+func (api *testAPI) mediaFiles(media mediaResponse) []string {
+	var files []string
+	for _, url := range []string{media.URL, media.ThumbnailURL} {
+		files = append(files, filepath.Join(api.cfg.MediaDir, strings.TrimPrefix(url, api.cfg.MediaURL+"/")))
+	}
+	return files
+}
+
+func checkFilesGone(t *testing.T, files []string, gone bool) {
+	t.Helper()
+	for _, file := range files {
+		_, err := os.Stat(file)
+		if gone && !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", file, err)
+		}
+		if !gone && err != nil {
+			t.Errorf("Expected %s to be kept, got %v", file, err)
+		}
+	}
+}
+
+// Purging a chirp takes its attachments with it, on disk and in the DB, and
+// a purged chirp holding up replies keeps nothing but its place
+func TestPurgeRemovesMedia(t *testing.T) {
+	db := NewMemoryDB()
+	api := newTestAPI(t, db)
+	login := api.signUp("a@example.com")
+	first, second := api.upload(login.Token), api.upload(login.Token)
+
+	lone, parent := chirpsResponse{}, chirpsResponse{}
+	api.do("POST", "/api/chirps", login.Token, jsonBody{Body: "lone", MediaIDs: []int{first.ID}}, &lone)
+	api.do("POST", "/api/chirps", login.Token, jsonBody{Body: "#tagged @a parent", MediaIDs: []int{second.ID}}, &parent)
+	api.do("POST", "/api/chirps", login.Token, jsonBody{Body: "reply", InReplyTo: parent.ID}, nil)
+	for _, id := range []int{lone.ID, parent.ID} {
+		status := api.do("DELETE", fmt.Sprintf("/api/chirps/%d", id), login.Token, nil, nil)
+		if status != http.StatusNoContent {
+			t.Fatalf("Deleting %d got %d", id, status)
+		}
+	}
+
+	// Nothing goes inside the retention window
+	api.cfg.cleanUp()
+	checkFilesGone(t, append(api.mediaFiles(first), api.mediaFiles(second)...), false)
+
+	backdateDeletion(db, lone.ID, chirpRetention+time.Hour)
+	backdateDeletion(db, parent.ID, chirpRetention+time.Hour)
+	api.cfg.cleanUp()
+	checkFilesGone(t, append(api.mediaFiles(first), api.mediaFiles(second)...), true)
+	media, _ := db.GetMediaByIDs([]int{first.ID, second.ID})
+	if len(media) != 0 {
+		t.Errorf("Expected the media records to be gone, got %+v", media)
+	}
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+	stub, ok := db.chirps.Chirps[parent.ID]
+	_, loneKept := db.chirps.Chirps[lone.ID]
+	if !ok || loneKept {
+		t.Fatalf("Expected only the parent to be kept as a stub")
+	}
+	want := Chirp{ID: parent.ID, Author: login.ID, DeletedAt: stub.DeletedAt}
+	if fmt.Sprintf("%+v", stub) != fmt.Sprintf("%+v", want) {
+		t.Errorf("Expected a bare stub, got %+v", stub)
+	}
+	if len(db.index.hashtags["tagged"]) != 0 || len(db.index.mediaChirps) != 0 {
+		t.Errorf("Expected the stub to be dropped from the hashtag and media indexes")
+	}
+}
+
+// Uploads nobody attaches go once they're old enough, attached ones stay
+func TestPruneUnattachedMedia(t *testing.T) {
+	db := NewMemoryDB()
+	api := newTestAPI(t, db)
+	login := api.signUp("a@example.com")
+	attached, unattached, recent := api.upload(login.Token), api.upload(login.Token), api.upload(login.Token)
+	api.do("POST", "/api/chirps", login.Token, jsonBody{Body: "hello", MediaIDs: []int{attached.ID}}, nil)
+
+	db.mux.Lock()
+	for _, id := range []int{attached.ID, unattached.ID} {
+		item := db.chirps.Media[id]
+		item.CreatedAt = item.CreatedAt.Add(-unattachedMediaRetention - time.Hour)
+		db.chirps.Media[id] = item
+	}
+	db.mux.Unlock()
+
+	api.cfg.cleanUp()
+	checkFilesGone(t, api.mediaFiles(unattached), true)
+	checkFilesGone(t, append(api.mediaFiles(attached), api.mediaFiles(recent)...), false)
+	media, _ := db.GetMediaByIDs([]int{attached.ID, unattached.ID, recent.ID})
+	if _, ok := media[unattached.ID]; ok || len(media) != 2 {
+		t.Errorf("Expected only the unattached upload's record to go, got %+v", media)
+	}
+}
@@ -0,0 +1,713 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a deleted chirp can still be restored before it's purged
+const chirpRetention = 30 * 24 * time.Hour
+
+// How long after posting an author can still edit a chirp
+const chirpEditWindow = 15 * time.Minute
+
+var (
+	errChirpNotFound    = errors.New("Chirp Does Not Exist")
+	errNotAuthor        = errors.New("Not the correct author")
+	errRestoreExpired   = errors.New("Chirp was deleted too long ago to restore")
+	errEmailTaken       = errors.New("Email already exists")
+	errEditExpired      = errors.New("Chirp is too old to edit")
+	errParentNotFound   = errors.New("Chirp being replied to does not exist")
+	errOriginalNotFound = errors.New("Chirp being rechirped or quoted does not exist")
+	errAlreadyRechirped = errors.New("Already rechirped")
+	errCantEditRechirp  = errors.New("Rechirps can't be edited")
+)
+
+// In-memory Store, nothing ever touches disk
+type MemoryDB struct {
+	chirpsCount        int
+	usersCount         int
+	notificationsCount int
+	mediaCount         int
+	chirps             DBChirp
+	mux                *sync.RWMutex
+	index              dbIndexes
+	// Persists changes before they're applied, nil for a pure in-memory DB
+	journal journal
+	// Told about chirps and notifications as they happen, never replayed
+	events *eventBus
+}
+
+// Lets a MemoryDB hand every change to something that persists it
+type journal interface {
+	// Durably records the change, called before it is applied
+	append(e walEntry) error
+	// Called once the change is applied, e.g. to compact the log
+	applied() error
+}
+
+func NewMemoryDB() *MemoryDB {
+	m := &MemoryDB{
+		chirpsCount:        1,
+		usersCount:         1,
+		notificationsCount: 1,
+		mediaCount:         1,
+		mux:                &sync.RWMutex{},
+		index:              newIndexes(),
+		events:             newEventBus(),
+	}
+	m.chirps.initMaps()
+	return m
+}
+
+// Records a change in the journal and then applies it in memory, callers
+// must hold mux for writing
+func (m *MemoryDB) commit(e walEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if m.journal != nil {
+		err := m.journal.append(e)
+		if err != nil {
+			return err
+		}
+	}
+	m.apply(e)
+	if m.journal != nil {
+		err := m.journal.applied()
+		if err != nil {
+			// The change is already durable in the log, so just report it
+			log.Println(err)
+		}
+	}
+	return nil
+}
+
+// Applies a single change, also used to replay the WAL on startup
+func (m *MemoryDB) apply(e walEntry) {
+	switch e.Op {
+	case opCreateChirp:
+		m.indexChirp(*e.Chirp)
+		m.chirps.Chirps[e.Chirp.ID] = *e.Chirp
+		if e.Chirp.ID >= m.chirpsCount {
+			m.chirpsCount = e.Chirp.ID + 1
+		}
+	case opEditChirp:
+		old, ok := m.chirps.Chirps[e.Chirp.ID]
+		// Replaying an edit that's already in the snapshot mustn't add a revision
+		if ok && !old.UpdatedAt.Equal(e.Chirp.UpdatedAt) {
+			m.chirps.Revisions[old.ID] = append(m.chirps.Revisions[old.ID], ChirpRevision{
+				Body:      old.Body,
+				CreatedAt: old.UpdatedAt,
+			})
+			// Hashtags may have changed
+			m.unindexChirp(old)
+			m.indexChirp(*e.Chirp)
+			m.chirps.Chirps[old.ID] = *e.Chirp
+		}
+	case opDeleteChirp:
+		chirp, ok := m.chirps.Chirps[e.ID]
+		if ok {
+			deletedAt := e.Time
+			chirp.DeletedAt = &deletedAt
+			m.chirps.Chirps[e.ID] = chirp
+		}
+	case opRestoreChirp:
+		chirp, ok := m.chirps.Chirps[e.ID]
+		if ok {
+			chirp.DeletedAt = nil
+			m.chirps.Chirps[e.ID] = chirp
+		}
+	case opPurgeChirp:
+		chirp, ok := m.chirps.Chirps[e.ID]
+		if !ok {
+			break
+		}
+		delete(m.chirps.Revisions, e.ID)
+		delete(m.chirps.Likes, e.ID)
+		for _, id := range chirp.MediaIDs {
+			delete(m.chirps.Media, id)
+		}
+		m.unindexChirp(chirp)
+		if len(m.index.replies[e.ID]) > 0 {
+			// Keep a bare stub so the replies still hang off something
+			stub := purgedStub(chirp)
+			m.indexChirp(stub)
+			m.chirps.Chirps[e.ID] = stub
+			break
+		}
+		delete(m.chirps.Chirps, e.ID)
+	case opCreateUser, opUpdateUser:
+		m.indexUser(*e.User)
+		m.chirps.Users[e.User.ID] = *e.User
+		if e.User.ID >= m.usersCount {
+			m.usersCount = e.User.ID + 1
+		}
+	case opUpgradeUser:
+		user, ok := m.chirps.Users[e.ID]
+		if ok {
+			user.ChirpyRed = true
+			user.UpdatedAt = e.Time
+			m.chirps.Users[e.ID] = user
+		}
+	case opFollow, opUnfollow:
+		m.applyFollow(e)
+	case opLike, opUnlike:
+		m.applyLike(e)
+	case opCreateNotification, opReadNotifications:
+		m.applyNotification(e)
+	case opCreateMedia, opDeleteMedia:
+		m.applyMedia(e)
+	case opRevokeToken, opCreateTokenFamily, opRotateRefreshToken, opRevokeTokenFamily, opPruneTokens:
+		m.applyTokens(e)
+	case opRotateSigningKey, opClearKeySecrets:
+		m.applySigningKey(e)
+	default:
+		log.Printf("Unknown DB operation %q", e.Op)
+	}
+}
+
+// Methods lock mux themselves: readers share it, anything that calls commit
+// holds it exclusively so the maps, counters and journal stay in step.
+
+func (m *MemoryDB) CreateChirp(params CreateChirpParams) (Chirp, error) {
+	// A plain rechirp is the only kind of chirp without a body
+	if params.Body == "" && params.RechirpOf == 0 && len(params.MediaIDs) == 0 {
+		return Chirp{}, fmt.Errorf("Body is empty")
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	now := time.Now().UTC()
+	newChirp := Chirp{
+		ID:        m.chirpsCount,
+		Body:      params.Body,
+		Author:    params.AuthorID,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Hashtags:  extractHashtags(params.Body),
+		Mentions:  m.resolveMentions(params.Body),
+	}
+	if params.InReplyTo != 0 {
+		parent, ok := m.chirps.Chirps[params.InReplyTo]
+		if !ok || parent.DeletedAt != nil {
+			return Chirp{}, errParentNotFound
+		}
+		newChirp.InReplyTo = parent.ID
+		newChirp.RootID = parent.RootID
+		if newChirp.RootID == 0 {
+			newChirp.RootID = parent.ID
+		}
+	}
+	if params.RechirpOf != 0 {
+		original, err := m.liveOriginal(params.RechirpOf)
+		if err != nil {
+			return Chirp{}, err
+		}
+		for _, id := range m.index.rechirps[original.ID] {
+			rechirp := m.chirps.Chirps[id]
+			if rechirp.Author == params.AuthorID && rechirp.Body == "" && rechirp.DeletedAt == nil {
+				return Chirp{}, errAlreadyRechirped
+			}
+		}
+		newChirp.Body = ""
+		newChirp.RechirpOf = original.ID
+	}
+	if params.QuoteOf != 0 {
+		original, err := m.liveOriginal(params.QuoteOf)
+		if err != nil {
+			return Chirp{}, err
+		}
+		newChirp.QuoteOf = original.ID
+	}
+	if len(params.MediaIDs) > 0 {
+		err := m.checkAttachments(params.MediaIDs, params.AuthorID)
+		if err != nil {
+			return Chirp{}, err
+		}
+		newChirp.MediaIDs = params.MediaIDs
+	}
+	err := m.commit(walEntry{Op: opCreateChirp, Chirp: &newChirp, Time: now})
+	if err != nil {
+		return Chirp{}, err
+	}
+	// The parent's author hears about it as a reply rather than a mention
+	var told []Mention
+	if newChirp.InReplyTo != 0 {
+		parent := m.chirps.Chirps[newChirp.InReplyTo]
+		told = append(told, Mention{UserID: parent.Author})
+		if parent.Author != newChirp.Author {
+			err = m.notify(Notification{
+				UserID:  parent.Author,
+				Type:    notificationReply,
+				ActorID: newChirp.Author,
+				ChirpID: newChirp.ID,
+			})
+			if err != nil {
+				return Chirp{}, err
+			}
+		}
+	}
+	err = m.notifyMentions(newChirp, told)
+	if err != nil {
+		return Chirp{}, err
+	}
+	m.events.publish(Event{Type: eventChirpCreated, Chirp: &newChirp})
+	return newChirp, nil
+}
+
+// Resolves the chirp being rechirped or quoted, going through plain
+// rechirps so they always point at the chirp with the actual content
+func (m *MemoryDB) liveOriginal(id int) (Chirp, error) {
+	original, ok := m.chirps.Chirps[id]
+	if ok && original.RechirpOf != 0 {
+		original, ok = m.chirps.Chirps[original.RechirpOf]
+	}
+	if !ok || original.DeletedAt != nil {
+		return Chirp{}, errOriginalNotFound
+	}
+	return original, nil
+}
+
+// Soft deletes a chirp, it stays restorable by its author for chirpRetention
+func (m *MemoryDB) DeleteChirp(chirpID, authorID int) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	checker, ok := m.chirps.Chirps[chirpID]
+	if !ok || checker.DeletedAt != nil {
+		return errChirpNotFound
+	}
+
+	if checker.Author != authorID {
+		return errNotAuthor
+	}
+
+	err := m.commit(walEntry{Op: opDeleteChirp, ID: chirpID})
+	if err != nil {
+		return err
+	}
+	deleted := m.chirps.Chirps[chirpID]
+	m.events.publish(Event{Type: eventChirpDeleted, Chirp: &deleted})
+	return nil
+}
+
+// The bus new chirps, deletions and notifications are published to
+func (m *MemoryDB) Events() *eventBus {
+	return m.events
+}
+
+// Replaces the body of a chirp, keeping the old one in its history
+func (m *MemoryDB) EditChirp(chirpID, authorID int, body string) (Chirp, error) {
+	if body == "" {
+		return Chirp{}, fmt.Errorf("Body is empty")
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	chirp, ok := m.chirps.Chirps[chirpID]
+	if !ok || chirp.DeletedAt != nil {
+		return Chirp{}, errChirpNotFound
+	}
+	if chirp.Author != authorID {
+		return Chirp{}, errNotAuthor
+	}
+	if chirp.RechirpOf != 0 {
+		return Chirp{}, errCantEditRechirp
+	}
+	if time.Since(chirp.CreatedAt) > chirpEditWindow {
+		return Chirp{}, errEditExpired
+	}
+
+	now := time.Now().UTC()
+	chirp.Body = body
+	chirp.UpdatedAt = now
+	chirp.Hashtags = extractHashtags(body)
+	before := chirp.Mentions
+	chirp.Mentions = m.resolveMentions(body)
+	err := m.commit(walEntry{Op: opEditChirp, Chirp: &chirp, Time: now})
+	if err != nil {
+		return Chirp{}, err
+	}
+	err = m.notifyMentions(chirp, before)
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+// Every version of a chirp's body, oldest first and ending with the current one
+func (m *MemoryDB) GetChirpHistory(chirpID int) ([]ChirpRevision, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	chirp, ok := m.chirps.Chirps[chirpID]
+	if !ok || chirp.DeletedAt != nil {
+		return nil, errChirpNotFound
+	}
+	revisions := m.chirps.Revisions[chirpID]
+	history := make([]ChirpRevision, 0, len(revisions)+1)
+	history = append(history, revisions...)
+	history = append(history, ChirpRevision{
+		Body:      chirp.Body,
+		CreatedAt: chirp.UpdatedAt,
+	})
+	return history, nil
+}
+
+// Every chirp in the conversation chirpID belongs to, keyed by ID. Deleted
+// chirps are included as stubs so the tree keeps its shape.
+func (m *MemoryDB) GetConversation(chirpID int) (map[int]Chirp, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	chirp, ok := m.chirps.Chirps[chirpID]
+	if !ok {
+		return nil, errChirpNotFound
+	}
+	rootID := chirp.RootID
+	if rootID == 0 {
+		rootID = chirp.ID
+	}
+
+	conversation := map[int]Chirp{}
+	queue := []int{rootID}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		c, ok := m.chirps.Chirps[id]
+		if !ok {
+			continue
+		}
+		if c.DeletedAt != nil {
+			c = deletedStub(c)
+		}
+		conversation[id] = c
+		queue = append(queue, m.index.replies[id]...)
+	}
+	return conversation, nil
+}
+
+// What's left of a deleted chirp in a conversation, just enough to keep its
+// place in the tree
+func deletedStub(chirp Chirp) Chirp {
+	return Chirp{
+		ID:        chirp.ID,
+		InReplyTo: chirp.InReplyTo,
+		RootID:    chirp.RootID,
+		CreatedAt: chirp.CreatedAt,
+		UpdatedAt: chirp.UpdatedAt,
+		DeletedAt: chirp.DeletedAt,
+	}
+}
+
+// All that's kept of a purged chirp that still has replies, who wrote it and
+// where it sat in the conversation
+func purgedStub(chirp Chirp) Chirp {
+	return Chirp{
+		ID:        chirp.ID,
+		Author:    chirp.Author,
+		InReplyTo: chirp.InReplyTo,
+		RootID:    chirp.RootID,
+		DeletedAt: chirp.DeletedAt,
+	}
+}
+
+// Brings back a soft deleted chirp if it's still inside the retention window
+func (m *MemoryDB) RestoreChirp(chirpID, authorID int) (Chirp, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	chirp, ok := m.chirps.Chirps[chirpID]
+	if !ok || chirp.DeletedAt == nil {
+		return Chirp{}, errChirpNotFound
+	}
+	if chirp.Author != authorID {
+		return Chirp{}, errNotAuthor
+	}
+	if time.Since(*chirp.DeletedAt) > chirpRetention {
+		return Chirp{}, errRestoreExpired
+	}
+
+	err := m.commit(walEntry{Op: opRestoreChirp, ID: chirpID})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return m.chirps.Chirps[chirpID], nil
+}
+
+// Drops tombstones that are past the retention window for good. Returns the
+// media that went with them, removing the files is up to the caller.
+func (m *MemoryDB) purgeDeletedChirps() ([]Media, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	purged := 0
+	var media []Media
+	for id, chirp := range m.chirps.Chirps {
+		if chirp.DeletedAt == nil || time.Since(*chirp.DeletedAt) <= chirpRetention {
+			continue
+		}
+		// Already purged down to a stub that's still holding up replies.
+		// Every chirp has a body, a rechirp or media until then.
+		stub := chirp.Body == "" && chirp.RechirpOf == 0 && chirp.QuoteOf == 0 && len(chirp.MediaIDs) == 0
+		if stub && len(m.index.replies[id]) > 0 {
+			continue
+		}
+		var attached []Media
+		for _, mediaID := range chirp.MediaIDs {
+			if item, ok := m.chirps.Media[mediaID]; ok {
+				attached = append(attached, item)
+			}
+		}
+		err := m.commit(walEntry{Op: opPurgeChirp, ID: id})
+		if err != nil {
+			return media, err
+		}
+		media = append(media, attached...)
+		purged++
+	}
+	if purged > 0 {
+		log.Printf("Purged %d deleted chirps", purged)
+	}
+	return media, nil
+}
+
+// handle is optional here, users without one just can't be @mentioned
+func (m *MemoryDB) CreateUser(email, password, handle string) (User, error) {
+	if email == "" {
+		return User{}, fmt.Errorf("Body is empty")
+	}
+	if handle != "" {
+		err := validateHandle(handle)
+		if err != nil {
+			return User{}, err
+		}
+	}
+	// bcrypt is slow, don't hold the lock for it
+	hashedPW, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	_, taken := m.index.emails[emailKey(email)]
+	if taken {
+		return User{}, errEmailTaken
+	}
+	if handle != "" {
+		_, taken = m.index.handles[handleKey(handle)]
+		if taken {
+			return User{}, errHandleTaken
+		}
+	}
+	now := time.Now().UTC()
+	newUser := User{
+		Password:  hashedPW,
+		ID:        m.usersCount,
+		Email:     email,
+		Handle:    handle,
+		ChirpyRed: false,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	err = m.commit(walEntry{Op: opCreateUser, User: &newUser, Time: now})
+	if err != nil {
+		return User{}, err
+	}
+	return newUser, nil
+}
+
+// Applies whichever fields params sets, see UpdateUserParams
+func (m *MemoryDB) UpdateUser(id int, params UpdateUserParams) (User, error) {
+	err := params.validate()
+	if err != nil {
+		return User{}, err
+	}
+	// bcrypt is slow, don't hold the lock for it
+	var hashedPass string
+	if params.Password != nil {
+		hashedPass, err = hashPassword(*params.Password)
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	user, ok := m.chirps.Users[id]
+	if !ok {
+		return User{}, errUserNotFound
+	}
+	if params.Email != nil {
+		owner, taken := m.index.emails[emailKey(*params.Email)]
+		if taken && owner != id {
+			return User{}, errEmailTaken
+		}
+		user.Email = *params.Email
+	}
+	if params.Handle != nil {
+		owner, taken := m.index.handles[handleKey(*params.Handle)]
+		if taken && owner != id {
+			return User{}, errHandleTaken
+		}
+		user.Handle = *params.Handle
+	}
+	if params.Password != nil {
+		user.Password = hashedPass
+	}
+	if params.DisplayName != nil {
+		user.DisplayName = strings.TrimSpace(*params.DisplayName)
+	}
+	if params.Bio != nil {
+		user.Bio = strings.TrimSpace(*params.Bio)
+	}
+	if params.AvatarURL != nil {
+		user.AvatarURL = *params.AvatarURL
+	}
+
+	now := time.Now().UTC()
+	user.UpdatedAt = now
+	err = m.commit(walEntry{Op: opUpdateUser, User: &user, Time: now})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (m *MemoryDB) checkLogin(email string) (User, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	id, ok := m.index.emails[emailKey(email)]
+	if !ok {
+		return User{}, fmt.Errorf("User doesn't exist")
+	}
+	return m.chirps.Users[id], nil
+}
+
+// Returns nil if the refresh token with ID tokenID has been revoked
+func (m *MemoryDB) checkRevokedDB(tokenID string) error {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	_, ok := m.chirps.RevokedTokens[tokenID]
+	if !ok {
+		return fmt.Errorf("Token not found")
+	}
+	return nil
+}
+
+// Revokes a refresh token by its ID, the entry is kept until expiresAt
+// since the token can't validate after that anyway
+func (m *MemoryDB) revokeToken(tokenID string, expiresAt time.Time) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	_, ok := m.chirps.RevokedTokens[tokenID]
+	if !ok {
+		return m.commit(walEntry{Op: opRevokeToken, Token: tokenID, ExpiresAt: &expiresAt})
+	}
+	return fmt.Errorf("Token already revoked")
+}
+
+// Returns a copy so callers can range over it without holding the lock,
+// deleted chirps are left out
+func (m *MemoryDB) GetChirps() (map[int]Chirp, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	chirps := make(map[int]Chirp, len(m.chirps.Chirps))
+	for id, chirp := range m.chirps.Chirps {
+		if chirp.DeletedAt != nil {
+			continue
+		}
+		chirps[id] = chirp
+	}
+	return chirps, nil
+}
+
+// Uses the author index, oldest first
+func (m *MemoryDB) GetChirpsByAuthor(authorID int) ([]Chirp, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	ids := m.index.authors[authorID]
+	chirps := make([]Chirp, 0, len(ids))
+	for _, id := range ids {
+		chirp := m.chirps.Chirps[id]
+		if chirp.DeletedAt != nil {
+			continue
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, nil
+}
+
+// Chirps with IDs between minID and maxID, both exclusive and 0 for no
+// bound, only authorID's unless that's 0. Walks the ID index newest first if
+// desc and stops at limit, 0 for no limit. The bool says if there were more.
+func (m *MemoryDB) ListChirps(authorID, minID, maxID int, desc bool, limit int) ([]Chirp, bool, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	ids := m.index.chirps
+	if authorID != 0 {
+		ids = m.index.authors[authorID]
+	}
+	lo, hi := sort.SearchInts(ids, minID+1), len(ids)
+	if maxID > 0 {
+		hi = sort.SearchInts(ids, maxID)
+	}
+
+	chirps := []Chirp{}
+	for i := 0; i < hi-lo; i++ {
+		pos := lo + i
+		if desc {
+			pos = hi - 1 - i
+		}
+		chirp := m.chirps.Chirps[ids[pos]]
+		if chirp.DeletedAt != nil {
+			continue
+		}
+		if limit > 0 && len(chirps) == limit {
+			return chirps, true, nil
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, false, nil
+}
+
+// Looks up several chirps at once, missing and deleted ones are left out
+func (m *MemoryDB) GetChirpsByIDs(ids []int) (map[int]Chirp, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	chirps := make(map[int]Chirp, len(ids))
+	for _, id := range ids {
+		chirp, ok := m.chirps.Chirps[id]
+		if !ok || chirp.DeletedAt != nil {
+			continue
+		}
+		chirps[id] = chirp
+	}
+	return chirps, nil
+}
+
+func (m *MemoryDB) GetChirpByID(id int) (Chirp, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	chirp, ok := m.chirps.Chirps[id]
+	if !ok || chirp.DeletedAt != nil {
+		return Chirp{}, errChirpNotFound
+	}
+	return chirp, nil
+}
+
+func (m *MemoryDB) upgradeUser(userID int) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	_, ok := m.chirps.Users[userID]
+	if !ok {
+		return fmt.Errorf("User not found")
+	}
+	return m.commit(walEntry{Op: opUpgradeUser, ID: userID})
+}
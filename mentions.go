@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// An @ at the start or after anything that isn't part of a word or address,
+// followed by a handle that ends where the word does. The trailing boundary
+// is matched too, so findMentions resumes the next search on the handle's
+// last character rather than after it.
+var mentionRegex = regexp.MustCompile(`(?:^|[^\w@.])@(\w{1,15})(?:$|\W)`)
+
+var handleRegex = regexp.MustCompile(`^\w{1,15}$`)
+
+var (
+	errInvalidHandle = errors.New("Handles are 1-15 letters, numbers or underscores")
+	errHandleTaken   = errors.New("Handle already exists")
+)
+
+// A user mentioned in a chirp, resolved when the chirp was written
+type Mention struct {
+	UserID int    `json:"user_id"`
+	Handle string `json:"handle"`
+}
+
+func handleKey(handle string) string {
+	return strings.ToLower(handle)
+}
+
+func validateHandle(handle string) error {
+	if !handleRegex.MatchString(handle) {
+		return errInvalidHandle
+	}
+	return nil
+}
+
+// Returns every @handle in body, in order
+func findMentions(body string) []string {
+	var handles []string
+	start := 0
+	for start < len(body) {
+		loc := mentionRegex.FindStringSubmatchIndex(body[start:])
+		if loc == nil {
+			break
+		}
+		handles = append(handles, body[start+loc[2]:start+loc[3]])
+		// The handle's last character is a word character, so it can't
+		// stand in for ^ or the character before the next @
+		start += loc[3] - 1
+	}
+	return handles
+}
+
+// Finds the @handles in body that belong to real users, unknown ones are
+// left alone as plain text. Callers must hold mux.
+func (m *MemoryDB) resolveMentions(body string) []Mention {
+	var mentions []Mention
+	seen := map[int]struct{}{}
+	for _, handle := range findMentions(body) {
+		userID, ok := m.index.handles[handleKey(handle)]
+		if !ok {
+			continue
+		}
+		if _, ok := seen[userID]; ok {
+			continue
+		}
+		seen[userID] = struct{}{}
+		mentions = append(mentions, Mention{
+			UserID: userID,
+			Handle: m.chirps.Users[userID].Handle,
+		})
+	}
+	return mentions
+}
+
+// Notifies everyone mentioned in chirp that wasn't already in before.
+// Callers must hold mux for writing.
+func (m *MemoryDB) notifyMentions(chirp Chirp, before []Mention) error {
+	already := map[int]struct{}{}
+	for _, mention := range before {
+		already[mention.UserID] = struct{}{}
+	}
+	for _, mention := range chirp.Mentions {
+		if _, ok := already[mention.UserID]; ok || mention.UserID == chirp.Author {
+			continue
+		}
+		err := m.notify(Notification{
+			UserID:  mention.UserID,
+			Type:    notificationMention,
+			ActorID: chirp.Author,
+			ChirpID: chirp.ID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
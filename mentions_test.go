@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFindMentions(t *testing.T) {
+	cases := map[string][]string{
+		"@alice hi":                      {"alice"},
+		"hi @alice, @bob and @carol":     {"alice", "bob", "carol"},
+		"@alice @bob":                    {"alice", "bob"},
+		"(@alice)":                       {"alice"},
+		"@abcdefghijklmnopq is too long": nil,
+		"@abcdefghijklmno fits":          {"abcdefghijklmno"},
+		"mail me at x@foo.com":           nil,
+		"or at x.@foo":                   nil,
+		"@@alice":                        nil,
+		"@":                              nil,
+	}
+	for body, want := range cases {
+		got := findMentions(body)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("findMentions(%q) = %q, want %q", body, got, want)
+		}
+	}
+}
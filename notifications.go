@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const defaultNotificationsLimit = 20
+
+// Kinds of notification
+const (
+	notificationMention = "mention"
+	notificationReply   = "reply"
+	notificationLike    = "like"
+	notificationFollow  = "follow"
+)
+
+type Notification struct {
+	ID int `json:"id"`
+	// Who it's for
+	UserID int    `json:"user_id"`
+	Type   string `json:"type"`
+	// Who caused it and, if there's one involved, which chirp
+	ActorID   int       `json:"actor_id"`
+	ChirpID   int       `json:"chirp_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Read      bool      `json:"read"`
+}
+
+func (m *MemoryDB) applyNotification(e walEntry) {
+	if e.Op == opReadNotifications {
+		for _, id := range e.IDs {
+			n, ok := m.chirps.Notifications[id]
+			if !ok || n.Read {
+				continue
+			}
+			n.Read = true
+			m.chirps.Notifications[id] = n
+			m.decrementUnread(n.UserID)
+		}
+		return
+	}
+	n := *e.Notification
+	if n.ID >= m.notificationsCount {
+		m.notificationsCount = n.ID + 1
+	}
+	// Replaying one that's already in the snapshot mustn't count it twice
+	if old, ok := m.chirps.Notifications[n.ID]; ok && !old.Read {
+		m.decrementUnread(old.UserID)
+	}
+	m.chirps.Notifications[n.ID] = n
+	m.index.notifications[n.UserID] = insertID(m.index.notifications[n.UserID], n.ID)
+	if !n.Read {
+		m.index.unread[n.UserID]++
+	}
+}
+
+func (m *MemoryDB) decrementUnread(userID int) {
+	m.index.unread[userID]--
+	if m.index.unread[userID] <= 0 {
+		delete(m.index.unread, userID)
+	}
+}
+
+// Stores a new notification, callers must hold mux for writing
+func (m *MemoryDB) notify(n Notification) error {
+	n.ID = m.notificationsCount
+	n.CreatedAt = time.Now().UTC()
+	err := m.commit(walEntry{Op: opCreateNotification, Notification: &n, Time: n.CreatedAt})
+	if err != nil {
+		return err
+	}
+	m.events.publish(Event{Type: eventNotification, Notification: &n})
+	return nil
+}
+
+// userID's notifications, newest first, starting below beforeID (0 for the
+// top). Returns whether there's more.
+func (m *MemoryDB) GetNotifications(userID, beforeID, limit int, unreadOnly bool) ([]Notification, bool, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	ids := m.index.notifications[userID]
+	pos := len(ids) - 1
+	if beforeID > 0 {
+		pos = sort.SearchInts(ids, beforeID) - 1
+	}
+	notifications := []Notification{}
+	for ; pos >= 0; pos-- {
+		n := m.chirps.Notifications[ids[pos]]
+		if unreadOnly && n.Read {
+			continue
+		}
+		if len(notifications) == limit {
+			return notifications, true, nil
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, false, nil
+}
+
+func (m *MemoryDB) CountUnreadNotifications(userID int) (int, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	return m.index.unread[userID], nil
+}
+
+// Marks the given notifications read, or all of them when ids is empty.
+// IDs that don't belong to userID are ignored. Returns what's left unread.
+func (m *MemoryDB) MarkNotificationsRead(userID int, ids []int) (int, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if len(ids) == 0 {
+		ids = m.index.notifications[userID]
+	}
+	toRead := []int{}
+	for _, id := range ids {
+		n, ok := m.chirps.Notifications[id]
+		if ok && n.UserID == userID && !n.Read {
+			toRead = append(toRead, id)
+		}
+	}
+	if len(toRead) > 0 {
+		err := m.commit(walEntry{Op: opReadNotifications, UserID: userID, IDs: toRead})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return m.index.unread[userID], nil
+}
+
+type unreadResponse struct {
+	UnreadCount int `json:"unread_count"`
+}
+
+type notificationsResponse struct {
+	UnreadCount   int            `json:"unread_count"`
+	Notifications []Notification `json:"notifications"`
+}
+
+// The caller's notifications, newest first. ?unread=true skips read ones.
+func (cfg *apiConfig) handlerGetNotifications(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Get Notifications")
+	userID, err := cfg.getUserID(r)
+	if err != nil {
+		errorResp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	page, err := parsePageParams(r.URL.Query())
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if page.limit == 0 {
+		page.limit = defaultNotificationsLimit
+	}
+	beforeID := 0
+	if page.after != nil {
+		beforeID = page.after.ID
+	}
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+
+	notifications, hasNext, err := cfg.database.GetNotifications(userID, beforeID, page.limit, unreadOnly)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	unread, err := cfg.database.CountUnreadNotifications(userID)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if hasNext {
+		cursor := pageCursor{ID: notifications[len(notifications)-1].ID}.encode()
+		w.Header().Set("Link", pageLink(r, "after", cursor, "next"))
+		w.Header().Set("X-Next-Cursor", cursor)
+	}
+	jsonResp(w, http.StatusOK, notificationsResponse{
+		UnreadCount:   unread,
+		Notifications: notifications,
+	})
+}
+
+// Marks notifications read: {"ids": [1, 2]} or {"all": true}
+func (cfg *apiConfig) handlerReadNotifications(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Read Notifications")
+	type readRequest struct {
+		IDs []int `json:"ids"`
+		All bool  `json:"all"`
+	}
+	userID, err := cfg.getUserID(r)
+	if err != nil {
+		errorResp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	checker := readRequest{}
+	err = json.NewDecoder(r.Body).Decode(&checker)
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+	if len(checker.IDs) == 0 && !checker.All {
+		errorResp(w, http.StatusBadRequest, "Give some ids or all")
+		return
+	}
+	if checker.All {
+		checker.IDs = nil
+	}
+
+	unread, err := cfg.database.MarkNotificationsRead(userID, checker.IDs)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	jsonResp(w, http.StatusOK, unreadResponse{UnreadCount: unread})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxPageLimit = 100
+
+// Position in a sorted list of chirps, handed to clients as an opaque string.
+// It holds the sort keys of the last item seen rather than an offset so
+// pages don't shift when new chirps arrive.
+type pageCursor struct {
+	ID        int       `json:"id"`
+	CreatedAt time.Time `json:"c,omitempty"`
+	UpdatedAt time.Time `json:"u,omitempty"`
+}
+
+type pageParams struct {
+	limit  int
+	after  *pageCursor
+	before *pageCursor
+}
+
+func encodeCursor(chirp chirpsResponse) string {
+	return pageCursor{
+		ID:        chirp.ID,
+		CreatedAt: chirp.CreatedAt,
+		UpdatedAt: chirp.UpdatedAt,
+	}.encode()
+}
+
+func (c pageCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	cursor := pageCursor{}
+	err = json.Unmarshal(data, &cursor)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cursor")
+	}
+	return &cursor, nil
+}
+
+// Reads limit, cursor/after and before from the query string. No limit means
+// everything, which is what clients got before pagination existed.
+func parsePageParams(query url.Values) (pageParams, error) {
+	params := pageParams{}
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			return pageParams{}, fmt.Errorf("Invalid limit")
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+		params.limit = limit
+	}
+
+	after := query.Get("after")
+	if after == "" {
+		after = query.Get("cursor")
+	}
+	if after != "" {
+		cursor, err := decodeCursor(after)
+		if err != nil {
+			return pageParams{}, err
+		}
+		params.after = cursor
+	}
+	if before := query.Get("before"); before != "" {
+		cursor, err := decodeCursor(before)
+		if err != nil {
+			return pageParams{}, err
+		}
+		params.before = cursor
+	}
+	return params, nil
+}
+
+// Cuts one page out of chirps, which must already be sorted with less.
+// Returns the page and whether there's anything after or before it.
+func paginateChirps(chirps []chirpsResponse, less func(a, b chirpsResponse) bool, params pageParams) ([]chirpsResponse, bool, bool) {
+	start, end := 0, len(chirps)
+	if params.after != nil {
+		mark := params.after.chirp()
+		start = sort.Search(len(chirps), func(i int) bool {
+			return less(mark, chirps[i])
+		})
+	}
+	if params.before != nil {
+		mark := params.before.chirp()
+		end = sort.Search(len(chirps), func(i int) bool {
+			return !less(chirps[i], mark)
+		})
+	}
+	if end < start {
+		end = start
+	}
+
+	if params.limit > 0 && end-start > params.limit {
+		// Paging backwards keeps the items closest to the before cursor
+		if params.before != nil && params.after == nil {
+			start = end - params.limit
+		} else {
+			end = start + params.limit
+		}
+	}
+	return chirps[start:end], end < len(chirps), start > 0
+}
+
+// One page of chirps in ID order, straight off the store's index rather than
+// sorting them all. Creation order follows IDs, so this serves sort_by=id and
+// created_at. Returns the page and whether there's anything after or before it.
+func (cfg *apiConfig) pageChirpsByID(authorID int, desc bool, params pageParams) ([]Chirp, bool, bool, error) {
+	// Stored in ID ranges, so list order and ID order may be flipped
+	between := func(first, last int) (int, int) {
+		if desc {
+			return last, first
+		}
+		return first, last
+	}
+	// Whether anything is in the range, deleted chirps don't count
+	nonEmpty := func(minID, maxID int) (bool, error) {
+		chirps, _, err := cfg.database.ListChirps(authorID, minID, maxID, false, 1)
+		return len(chirps) > 0, err
+	}
+	var afterID, beforeID int
+	if params.after != nil {
+		afterID = params.after.ID
+	}
+	if params.before != nil {
+		beforeID = params.before.ID
+	}
+
+	// Paging backwards keeps the items closest to the before cursor
+	backwards := params.before != nil && params.after == nil
+	minID, maxID := between(afterID, beforeID)
+	chirps, more, err := cfg.database.ListChirps(authorID, minID, maxID, desc != backwards, params.limit)
+	if err != nil {
+		return nil, false, false, err
+	}
+	hasNext, hasPrev := more, false
+	if backwards {
+		for i, j := 0, len(chirps)-1; i < j; i, j = i+1, j-1 {
+			chirps[i], chirps[j] = chirps[j], chirps[i]
+		}
+		hasNext, hasPrev = false, more
+	}
+
+	// The cursor chirps themselves are past the range, the step of one
+	// takes them back in
+	step := 1
+	if desc {
+		step = -1
+	}
+	if params.before != nil && !hasNext {
+		hasNext, err = nonEmpty(between(beforeID-step, 0))
+		if err != nil {
+			return nil, false, false, err
+		}
+	}
+	if params.after != nil && !hasPrev {
+		hasPrev, err = nonEmpty(between(0, afterID+step))
+		if err != nil {
+			return nil, false, false, err
+		}
+	}
+	return chirps, hasNext, hasPrev, nil
+}
+
+// The sort keys of a cursor as a chirp so it can go through less
+func (c *pageCursor) chirp() chirpsResponse {
+	return chirpsResponse{
+		ID:        c.ID,
+		CreatedAt: c.CreatedAt,
+		UpdatedAt: c.UpdatedAt,
+	}
+}
+
+// Adds RFC 8288 Link headers pointing at the next and previous pages
+func setPageLinks(w http.ResponseWriter, r *http.Request, page []chirpsResponse, hasNext, hasPrev bool) {
+	if len(page) == 0 {
+		return
+	}
+	var links []string
+	if hasNext {
+		links = append(links, pageLink(r, "after", encodeCursor(page[len(page)-1]), "next"))
+		w.Header().Set("X-Next-Cursor", encodeCursor(page[len(page)-1]))
+	}
+	if hasPrev {
+		links = append(links, pageLink(r, "before", encodeCursor(page[0]), "prev"))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+func pageLink(r *http.Request, param, cursor, rel string) string {
+	query := r.URL.Query()
+	query.Del("cursor")
+	query.Del("after")
+	query.Del("before")
+	query.Set(param, cursor)
+	link := url.URL{
+		Path:     r.URL.Path,
+		RawQuery: query.Encode(),
+	}
+	return fmt.Sprintf("<%s>; rel=\"%s\"", link.String(), rel)
+}
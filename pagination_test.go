@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Paging off the ID index has to give the same pages and links as sorting
+// everything and cutting a page out, which is what it replaced
+func TestPageChirpsByIDMatchesSorting(t *testing.T) {
+	db := NewMemoryDB()
+	for i := 0; i < 30; i++ {
+		mustCreateChirp(t, db, 1+i%3, fmt.Sprintf("chirp %d", i))
+	}
+	for _, id := range []int{1, 4, 5, 17, 30} {
+		chirp, err := db.GetChirpByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.DeleteChirp(id, chirp.Author)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &apiConfig{database: db}
+
+	for _, authorID := range []int{0, 2} {
+		var all []chirpsResponse
+		if authorID == 0 {
+			chirps, _ := db.GetChirps()
+			for _, chirp := range chirps {
+				all = append(all, newChirpResponse(chirp))
+			}
+		} else {
+			chirps, _ := db.GetChirpsByAuthor(authorID)
+			for _, chirp := range chirps {
+				all = append(all, newChirpResponse(chirp))
+			}
+		}
+		for _, order := range []string{"asc", "desc"} {
+			sorted := sortChirps(append([]chirpsResponse{}, all...), "id", order)
+			less := chirpLess("id", order)
+			// Cursors on live, deleted and out of range chirps
+			var cursors []*pageCursor
+			cursors = append(cursors, nil)
+			for _, id := range []int{1, 2, 5, 12, 13, 30, 31} {
+				cursors = append(cursors, &pageCursor{ID: id})
+			}
+			for _, after := range cursors {
+				for _, before := range cursors {
+					for _, limit := range []int{0, 1, 4} {
+						params := pageParams{limit: limit, after: after, before: before}
+						name := fmt.Sprintf("author %d %s after %v before %v limit %d", authorID, order, after, before, limit)
+						want, wantNext, wantPrev := paginateChirps(sorted, less, params)
+						got, gotNext, gotPrev, err := cfg.pageChirpsByID(authorID, order == "desc", params)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if fmt.Sprint(chirpIDs(got)) != fmt.Sprint(responseIDs(want)) {
+							t.Errorf("%s: got %v, expected %v", name, chirpIDs(got), responseIDs(want))
+						}
+						if len(want) > 0 && (gotNext != wantNext || gotPrev != wantPrev) {
+							t.Errorf("%s: got next %t prev %t, expected %t %t", name, gotNext, gotPrev, wantNext, wantPrev)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func chirpIDs(chirps []Chirp) []int {
+	ids := []int{}
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.ID)
+	}
+	return ids
+}
+
+func responseIDs(chirps []chirpsResponse) []int {
+	ids := []int{}
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.ID)
+	}
+	return ids
+}
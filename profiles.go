@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 160
+	maxAvatarURLLength   = 2048
+)
+
+var errInvalidProfile = errors.New("Invalid profile")
+
+func (p UpdateUserParams) validate() error {
+	if p.Email != nil && strings.TrimSpace(*p.Email) == "" {
+		return fmt.Errorf("%w, email is empty", errInvalidProfile)
+	}
+	if p.Password != nil && *p.Password == "" {
+		return fmt.Errorf("%w, password is empty", errInvalidProfile)
+	}
+	if p.Handle != nil {
+		err := validateHandle(*p.Handle)
+		if err != nil {
+			return err
+		}
+	}
+	if p.DisplayName != nil && utf8.RuneCountInString(strings.TrimSpace(*p.DisplayName)) > maxDisplayNameLength {
+		return fmt.Errorf("%w, display names are at most %d characters", errInvalidProfile, maxDisplayNameLength)
+	}
+	if p.Bio != nil && utf8.RuneCountInString(strings.TrimSpace(*p.Bio)) > maxBioLength {
+		return fmt.Errorf("%w, bios are at most %d characters", errInvalidProfile, maxBioLength)
+	}
+	if p.AvatarURL != nil && *p.AvatarURL != "" {
+		return validateAvatarURL(*p.AvatarURL)
+	}
+	return nil
+}
+
+// Avatars have to be absolute http(s) links, an empty string removes one
+func validateAvatarURL(s string) error {
+	if len(s) > maxAvatarURLLength {
+		return fmt.Errorf("%w, avatar URL is too long", errInvalidProfile)
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w, avatar URL must be an http or https link", errInvalidProfile)
+	}
+	return nil
+}
+
+func (m *MemoryDB) GetUserByID(id int) (User, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	user, ok := m.chirps.Users[id]
+	if !ok {
+		return User{}, errUserNotFound
+	}
+	return user, nil
+}
+
+// Handles are matched ignoring case
+func (m *MemoryDB) GetUserByHandle(handle string) (User, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	id, ok := m.index.handles[handleKey(handle)]
+	if !ok {
+		return User{}, errUserNotFound
+	}
+	return m.chirps.Users[id], nil
+}
+
+func newProfileResponse(user User) profileResponse {
+	return profileResponse{
+		ID:          user.ID,
+		Handle:      user.Handle,
+		DisplayName: user.DisplayName,
+		Bio:         user.Bio,
+		AvatarURL:   user.AvatarURL,
+		ChirpyRed:   user.ChirpyRed,
+		CreatedAt:   user.CreatedAt,
+	}
+}
+
+// Public profile, never includes the email or password
+func (cfg *apiConfig) handlerGetUser(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Get User")
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, "Error getting ID")
+		return
+	}
+	user, err := cfg.database.GetUserByID(userID)
+	if err != nil {
+		errorResp(w, http.StatusNotFound, err.Error())
+		return
+	}
+	jsonResp(w, http.StatusOK, newProfileResponse(user))
+}
+
+func (cfg *apiConfig) handlerGetUserByHandle(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Get User By Handle")
+	handle := strings.TrimPrefix(chi.URLParam(r, "handle"), "@")
+	user, err := cfg.database.GetUserByHandle(handle)
+	if err != nil {
+		errorResp(w, http.StatusNotFound, err.Error())
+		return
+	}
+	jsonResp(w, http.StatusOK, newProfileResponse(user))
+}
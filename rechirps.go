@@ -0,0 +1,53 @@
+package main
+
+import "log"
+
+// Embeds the chirp each rechirp or quote points at. If the original has
+// been deleted the chirp is kept but flagged so clients can show a
+// placeholder instead.
+func (cfg *apiConfig) addOriginals(chirps []chirpsResponse, viewerID int) {
+	var ids []int
+	for _, chirp := range chirps {
+		if chirp.RechirpOf != 0 {
+			ids = append(ids, chirp.RechirpOf)
+		}
+		if chirp.QuoteOf != 0 {
+			ids = append(ids, chirp.QuoteOf)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	originals, err := cfg.database.GetChirpsByIDs(ids)
+	if err != nil {
+		log.Printf("Error getting original chirps, %s", err)
+		return
+	}
+
+	resps := map[int]*chirpsResponse{}
+	list := make([]chirpsResponse, 0, len(originals))
+	for _, original := range originals {
+		list = append(list, newChirpResponse(original))
+	}
+	cfg.addLikes(list, viewerID)
+	cfg.addMedia(list)
+	for i := range list {
+		resps[list[i].ID] = &list[i]
+	}
+
+	for i := range chirps {
+		originalID := chirps[i].RechirpOf
+		if originalID == 0 {
+			originalID = chirps[i].QuoteOf
+		}
+		if originalID == 0 {
+			continue
+		}
+		original, ok := resps[originalID]
+		if !ok {
+			chirps[i].OriginalUnavailable = true
+			continue
+		}
+		chirps[i].Original = original
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxUserResults     = 10
+)
+
+// A parsed ?q=. Every term and phrase has to match, from narrows it to one
+// author.
+type searchQuery struct {
+	terms   []string
+	phrases [][]string
+	from    string
+}
+
+// Lowercased words, anything that isn't a letter, digit or _ splits them
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+// Splits q into "quoted phrases", from:handle and plain words
+func parseSearchQuery(q string) searchQuery {
+	query := searchQuery{}
+	for i, part := range strings.Split(q, `"`) {
+		// Odd parts are inside quotes, an unclosed quote runs to the end
+		if i%2 == 1 {
+			phrase := tokenize(part)
+			switch len(phrase) {
+			case 0:
+			case 1:
+				query.terms = append(query.terms, phrase[0])
+			default:
+				query.phrases = append(query.phrases, phrase)
+			}
+			continue
+		}
+		for _, field := range strings.Fields(part) {
+			if len(field) > 5 && strings.EqualFold(field[:5], "from:") {
+				query.from = strings.TrimPrefix(field[5:], "@")
+				continue
+			}
+			query.terms = append(query.terms, tokenize(field)...)
+		}
+	}
+	return query
+}
+
+// Every word the query needs, phrases included
+func (q searchQuery) allTerms() []string {
+	terms := append([]string{}, q.terms...)
+	for _, phrase := range q.phrases {
+		terms = append(terms, phrase...)
+	}
+	return terms
+}
+
+// Overwrites rather than appends so indexing the same chirp twice is harmless
+func (m *MemoryDB) indexChirpText(chirp Chirp) {
+	positions := map[string][]int{}
+	for pos, term := range tokenize(chirp.Body) {
+		positions[term] = append(positions[term], pos)
+	}
+	for term, list := range positions {
+		if m.index.terms[term] == nil {
+			m.index.terms[term] = map[int][]int{}
+		}
+		m.index.terms[term][chirp.ID] = list
+	}
+}
+
+func (m *MemoryDB) unindexChirpText(chirp Chirp) {
+	for _, term := range tokenize(chirp.Body) {
+		delete(m.index.terms[term], chirp.ID)
+		if len(m.index.terms[term]) == 0 {
+			delete(m.index.terms, term)
+		}
+	}
+}
+
+func userSearchTerms(user User) []string {
+	terms := tokenize(user.DisplayName)
+	if user.Handle != "" {
+		terms = append(terms, handleKey(user.Handle))
+	}
+	return terms
+}
+
+func (m *MemoryDB) indexUserText(user User) {
+	for _, term := range userSearchTerms(user) {
+		if m.index.userTerms[term] == nil {
+			m.index.userTerms[term] = map[int]struct{}{}
+		}
+		m.index.userTerms[term][user.ID] = struct{}{}
+	}
+}
+
+func (m *MemoryDB) unindexUserText(user User) {
+	for _, term := range userSearchTerms(user) {
+		delete(m.index.userTerms[term], user.ID)
+		if len(m.index.userTerms[term]) == 0 {
+			delete(m.index.userTerms, term)
+		}
+	}
+}
+
+// Chirps matching query, newest first, starting below beforeID (0 for the
+// top). Returns whether there's more.
+func (m *MemoryDB) SearchChirps(query searchQuery, beforeID, limit int) ([]Chirp, bool, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	authorID := 0
+	if query.from != "" {
+		id, ok := m.index.handles[handleKey(query.from)]
+		if !ok {
+			return []Chirp{}, false, nil
+		}
+		authorID = id
+	}
+
+	var candidates []int
+	terms := query.allTerms()
+	switch {
+	case len(terms) > 0:
+		// Start from the rarest word so there's the least to check
+		sort.Slice(terms, func(i, j int) bool {
+			return len(m.index.terms[terms[i]]) < len(m.index.terms[terms[j]])
+		})
+		for id := range m.index.terms[terms[0]] {
+			candidates = append(candidates, id)
+		}
+		sort.Ints(candidates)
+	case authorID != 0:
+		candidates = m.index.authors[authorID]
+	default:
+		return []Chirp{}, false, nil
+	}
+
+	pos := len(candidates) - 1
+	if beforeID > 0 {
+		pos = sort.SearchInts(candidates, beforeID) - 1
+	}
+	chirps := []Chirp{}
+	for ; pos >= 0; pos-- {
+		chirp := m.chirps.Chirps[candidates[pos]]
+		if chirp.DeletedAt != nil || (authorID != 0 && chirp.Author != authorID) {
+			continue
+		}
+		if !m.chirpMatches(chirp.ID, terms, query.phrases) {
+			continue
+		}
+		if len(chirps) == limit {
+			return chirps, true, nil
+		}
+		chirps = append(chirps, chirp)
+	}
+	return chirps, false, nil
+}
+
+// Whether chirpID has every term and every phrase, with a phrase's words
+// at consecutive positions. Callers must hold mux.
+func (m *MemoryDB) chirpMatches(chirpID int, terms []string, phrases [][]string) bool {
+	for _, term := range terms {
+		if _, ok := m.index.terms[term][chirpID]; !ok {
+			return false
+		}
+	}
+	for _, phrase := range phrases {
+		found := false
+		for _, start := range m.index.terms[phrase[0]][chirpID] {
+			found = true
+			for i, term := range phrase[1:] {
+				if !containsInt(m.index.terms[term][chirpID], start+i+1) {
+					found = false
+					break
+				}
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Positions are appended in order so they're already sorted
+func containsInt(sorted []int, n int) bool {
+	i := sort.SearchInts(sorted, n)
+	return i < len(sorted) && sorted[i] == n
+}
+
+// Users whose handle or display name has every term, by ID
+func (m *MemoryDB) SearchUsers(terms []string, limit int) ([]User, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	users := []User{}
+	if len(terms) == 0 {
+		return users, nil
+	}
+	var ids []int
+	for id := range m.index.userTerms[terms[0]] {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		matches := true
+		for _, term := range terms[1:] {
+			if _, ok := m.index.userTerms[term][id]; !ok {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		users = append(users, m.chirps.Users[id])
+		if len(users) == limit {
+			break
+		}
+	}
+	return users, nil
+}
+
+type searchResponse struct {
+	Chirps []chirpsResponse  `json:"chirps"`
+	Users  []profileResponse `json:"users"`
+}
+
+// Searches chirps and users. ?q= takes words, "exact phrases" and
+// from:handle, chirps come newest first and page like the timeline.
+// Users are only on the first page and not when from: is used.
+func (cfg *apiConfig) handlerSearch(w http.ResponseWriter, r *http.Request) {
+	query := parseSearchQuery(r.URL.Query().Get("q"))
+	if len(query.terms) == 0 && len(query.phrases) == 0 && query.from == "" {
+		errorResp(w, http.StatusBadRequest, "Search query is empty")
+		return
+	}
+	page, err := parsePageParams(r.URL.Query())
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if page.limit == 0 {
+		page.limit = defaultSearchLimit
+	}
+	beforeID := 0
+	if page.after != nil {
+		beforeID = page.after.ID
+	}
+
+	chirps, hasNext, err := cfg.database.SearchChirps(query, beforeID, page.limit)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := searchResponse{
+		Chirps: make([]chirpsResponse, 0, len(chirps)),
+		Users:  []profileResponse{},
+	}
+	for _, chirp := range chirps {
+		resp.Chirps = append(resp.Chirps, newChirpResponse(chirp))
+	}
+	cfg.decorateChirps(resp.Chirps, cfg.optionalUserID(r))
+
+	if beforeID == 0 && query.from == "" {
+		users, err := cfg.database.SearchUsers(query.allTerms(), maxUserResults)
+		if err != nil {
+			errorResp(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, user := range users {
+			resp.Users = append(resp.Users, newProfileResponse(user))
+		}
+	}
+	setPageLinks(w, r, resp.Chirps, hasNext, false)
+	jsonResp(w, http.StatusOK, resp)
+}
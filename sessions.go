@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// User agents are only shown back to the user, no need to keep huge ones
+const maxUserAgentLength = 256
+
+var (
+	errSessionNotFound = errors.New("Session does not exist")
+	errSessionRevoked  = errors.New("Session has been logged out")
+)
+
+type sessionResponse struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Whether this is the session the request was made with
+	Current bool `json:"current"`
+}
+
+// Whether a family can still be refreshed. Families from before sessions
+// were tracked have no expiry, their tokens still carry one.
+func (f TokenFamily) active(now time.Time) bool {
+	return f.RevokedAt == nil && (f.ExpiresAt.IsZero() || now.Before(f.ExpiresAt))
+}
+
+// The user's logged in sessions, most recently used first
+func (m *MemoryDB) GetSessions(userID int) ([]TokenFamily, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	now := time.Now().UTC()
+	sessions := []TokenFamily{}
+	for _, family := range m.chirps.TokenFamilies {
+		if family.UserID == userID && family.active(now) {
+			sessions = append(sessions, family)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions, nil
+}
+
+// Errors if the session has been revoked or has run out
+func (m *MemoryDB) CheckSession(sessionID string) error {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	family, ok := m.chirps.TokenFamilies[sessionID]
+	if !ok {
+		return errSessionNotFound
+	}
+	if !family.active(time.Now().UTC()) {
+		return errSessionRevoked
+	}
+	return nil
+}
+
+// Logs out one of the user's sessions
+func (m *MemoryDB) RevokeSession(userID int, sessionID string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	family, ok := m.chirps.TokenFamilies[sessionID]
+	if !ok || family.UserID != userID || !family.active(time.Now().UTC()) {
+		return errSessionNotFound
+	}
+	return m.commit(walEntry{Op: opRevokeTokenFamily, Value: family.ID, UserID: userID})
+}
+
+// Logs out every session of the user's apart from keepID, returns how many
+// were logged out
+func (m *MemoryDB) RevokeOtherSessions(userID int, keepID string) (int, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	now := time.Now().UTC()
+	revoked := 0
+	for _, family := range m.chirps.TokenFamilies {
+		if family.UserID != userID || family.ID == keepID || !family.active(now) {
+			continue
+		}
+		err := m.commit(walEntry{Op: opRevokeTokenFamily, Value: family.ID, UserID: userID})
+		if err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
+
+// Where a request came from, proxies in front aren't trusted to say
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func clientUserAgent(r *http.Request) string {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	return userAgent
+}
+
+// Lists where the user is logged in
+func (cfg *apiConfig) handlerGetSessions(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Get Sessions")
+	claims, userID, err := cfg.getSession(r)
+	if err != nil {
+		errorResp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	sessions, err := cfg.database.GetSessions(userID)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := make([]sessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		resp = append(resp, sessionResponse{
+			ID:         session.ID,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+			Current:    session.ID == claims.SessionID,
+		})
+	}
+	jsonResp(w, http.StatusOK, resp)
+}
+
+// Logs out one session, its refresh and access tokens stop working
+func (cfg *apiConfig) handlerDeleteSession(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Delete Session")
+	userID, err := cfg.getUserID(r)
+	if err != nil {
+		errorResp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	err = cfg.database.RevokeSession(userID, chi.URLParam(r, "id"))
+	if errors.Is(err, errSessionNotFound) {
+		errorResp(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Logs out every device except the one making the request
+func (cfg *apiConfig) handlerRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Revoke Other Sessions")
+	type revokeOthersResponse struct {
+		Revoked int `json:"revoked"`
+	}
+	claims, userID, err := cfg.getSession(r)
+	if err != nil {
+		errorResp(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	// Tokens from before sessions existed can't say which one to keep
+	if claims.SessionID == "" {
+		errorResp(w, http.StatusBadRequest, "Token has no session, log in again")
+		return
+	}
+	revoked, err := cfg.database.RevokeOtherSessions(userID, claims.SessionID)
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	jsonResp(w, http.StatusOK, revokeOthersResponse{Revoked: revoked})
+}
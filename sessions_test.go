@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// Once a session is logged out its access tokens are turned away by every
+// endpoint, not just the ones that list sessions
+func TestRevokedSessionLocksOutWrites(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	login := api.signUp("a@example.com")
+	other := api.login("a@example.com")
+	chirp := chirpsResponse{}
+	api.do("POST", "/api/chirps", login.Token, jsonBody{Body: "hello"}, &chirp)
+	deleted := chirpsResponse{}
+	api.do("POST", "/api/chirps", login.Token, jsonBody{Body: "bye"}, &deleted)
+	api.do("DELETE", fmt.Sprintf("/api/chirps/%d", deleted.ID), login.Token, nil, nil)
+
+	status := api.do("DELETE", "/api/sessions/"+login.SessionID, other.Token, nil, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("Revoking the session got %d", status)
+	}
+	requests := []struct {
+		method, path string
+		body         interface{}
+	}{
+		{"POST", "/api/chirps", jsonBody{Body: "still here"}},
+		{"PUT", "/api/users", jsonBody{Email: "b@example.com"}},
+		{"DELETE", fmt.Sprintf("/api/chirps/%d", chirp.ID), nil},
+		{"POST", fmt.Sprintf("/api/chirps/%d/restore", deleted.ID), nil},
+	}
+	for _, req := range requests {
+		status := api.do(req.method, req.path, login.Token, req.body, nil)
+		if status != http.StatusUnauthorized {
+			t.Errorf("%s %s: expected 401 with a revoked session, got %d", req.method, req.path, status)
+		}
+	}
+	if _, err := api.cfg.database.GetChirpByID(chirp.ID); err != nil {
+		t.Errorf("Expected the chirp to survive, got %v", err)
+	}
+
+	// The session that's still logged in can do all of it
+	status = api.do("POST", fmt.Sprintf("/api/chirps/%d/restore", deleted.ID), other.Token, nil, nil)
+	if status != http.StatusOK {
+		t.Errorf("Restoring from a live session got %d", status)
+	}
+}
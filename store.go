@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Everything the handlers need from storage, implemented by DB (JSON file)
+// and MemoryDB (no disk)
+type Store interface {
+	// Chirps
+	CreateChirp(params CreateChirpParams) (Chirp, error)
+	GetChirps() (map[int]Chirp, error)
+	GetChirpsByAuthor(authorID int) ([]Chirp, error)
+	ListChirps(authorID, minID, maxID int, desc bool, limit int) ([]Chirp, bool, error)
+	GetChirpByID(id int) (Chirp, error)
+	GetChirpsByIDs(ids []int) (map[int]Chirp, error)
+	EditChirp(chirpID, authorID int, body string) (Chirp, error)
+	GetChirpHistory(chirpID int) ([]ChirpRevision, error)
+	GetConversation(chirpID int) (map[int]Chirp, error)
+	DeleteChirp(chirpID, authorID int) error
+	RestoreChirp(chirpID, authorID int) (Chirp, error)
+	purgeDeletedChirps() ([]Media, error)
+	Events() *eventBus
+
+	// Users
+	CreateUser(email, password, handle string) (User, error)
+	UpdateUser(id int, params UpdateUserParams) (User, error)
+	GetUserByID(id int) (User, error)
+	GetUserByHandle(handle string) (User, error)
+	checkLogin(email string) (User, error)
+	upgradeUser(userID int) error
+
+	// Hashtags
+	GetChirpsByHashtag(tag string, beforeID, limit int) ([]Chirp, bool, error)
+	GetTrendingHashtags(window time.Duration, limit int) ([]TrendingTag, error)
+
+	// Search
+	SearchChirps(query searchQuery, beforeID, limit int) ([]Chirp, bool, error)
+	SearchUsers(terms []string, limit int) ([]User, error)
+
+	// Likes
+	LikeChirp(chirpID, userID int, reaction string) error
+	UnlikeChirp(chirpID, userID int) error
+	GetLikes(chirpID int) ([]Like, error)
+	GetLikeSummaries(chirpIDs []int, viewerID int) (map[int]LikeSummary, error)
+
+	// Follows
+	Follow(followerID, followeeID int) error
+	Unfollow(followerID, followeeID int) error
+	GetFollowers(userID int) ([]Follow, error)
+	GetFollowing(userID int) ([]Follow, error)
+	IsFollowing(followerID, followeeID int) (bool, error)
+	GetTimeline(userID, beforeID, limit int) ([]Chirp, bool, error)
+
+	// Media
+	CreateMedia(media Media) (Media, error)
+	GetMediaByIDs(ids []int) (map[int]Media, error)
+	pruneUnattachedMedia() ([]Media, error)
+
+	// Notifications
+	GetNotifications(userID, beforeID, limit int, unreadOnly bool) ([]Notification, bool, error)
+	CountUnreadNotifications(userID int) (int, error)
+	MarkNotificationsRead(userID int, ids []int) (int, error)
+
+	// Refresh tokens
+	checkRevokedDB(tokenID string) error
+	revokeToken(tokenID string, expiresAt time.Time) error
+	pruneExpiredTokens() error
+	StartTokenFamily(userID int, userAgent, ip string) (RefreshToken, error)
+	RotateRefreshToken(tokenID, ip string) (RefreshToken, error)
+	AdoptLegacyRefreshToken(token string, expiresAt time.Time, userID int, userAgent, ip string) (RefreshToken, error)
+	RevokeTokenFamily(tokenID string) error
+
+	// Signing keys
+	CurrentSigningKey() (SigningKey, error)
+	GetSigningKey(id string) (SigningKey, error)
+	GetSigningKeys() ([]SigningKey, error)
+	RotateSigningKey(key SigningKey) error
+	clearSigningKeySecrets() (int, error)
+
+	// Sessions
+	GetSessions(userID int) ([]TokenFamily, error)
+	CheckSession(sessionID string) error
+	RevokeSession(userID int, sessionID string) error
+	RevokeOtherSessions(userID int, keepID string) (int, error)
+}
+
+var (
+	_ Store = &DB{}
+	_ Store = &MemoryDB{}
+)
+
+// Picks a Store by name, "memory" for a throwaway DB or "json" (default)
+func newStore(kind, path string, reset bool) (Store, error) {
+	switch kind {
+	case "memory":
+		log.Println("Using in-memory database")
+		return NewMemoryDB(), nil
+	case "", "json":
+		if reset {
+			err := ResetDB(path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return NewDB(path)
+	default:
+		return nil, fmt.Errorf("Unknown DB_TYPE %q", kind)
+	}
+}
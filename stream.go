@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How often an idle stream sends a comment so proxies don't hang up on it
+const streamHeartbeat = 15 * time.Second
+
+// Payload of a chirp_deleted event
+type deletedChirpEvent struct {
+	ID     int `json:"id"`
+	Author int `json:"author_id"`
+}
+
+// Server-Sent Events feed of chirps being created and deleted. Takes
+// author_id like GET /chirps, and resumes from Last-Event-ID (header, or
+// last_event_id in the query) as long as the bus still has it in history.
+func (cfg *apiConfig) handlerStream(w http.ResponseWriter, r *http.Request) {
+	log.Println("Calling Stream")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		errorResp(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+	var authorID int
+	var err error
+	if s := r.URL.Query().Get("author_id"); s != "" {
+		authorID, err = strconv.Atoi(s)
+		if err != nil {
+			errorResp(w, http.StatusBadRequest, "Error getting ID")
+			return
+		}
+	}
+	var lastID int64
+	s := r.Header.Get("Last-Event-ID")
+	if s == "" {
+		s = r.URL.Query().Get("last_event_id")
+	}
+	if s != "" {
+		lastID, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			errorResp(w, http.StatusBadRequest, "Invalid Last-Event-ID")
+			return
+		}
+	}
+
+	bus := cfg.database.Events()
+	sub, backlog := bus.subscribe(lastID)
+	defer bus.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, e := range backlog {
+		err = cfg.writeStreamEvent(w, e, authorID)
+		if err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(streamHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-sub.events:
+			if !ok {
+				// Fell behind, the client reconnects with Last-Event-ID
+				log.Println("Dropping slow stream subscriber")
+				return
+			}
+			err = cfg.writeStreamEvent(w, e, authorID)
+		case <-ticker.C:
+			_, err = io.WriteString(w, ": heartbeat\n\n")
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// Writes one event in SSE format, skipping it if it doesn't match authorID
+func (cfg *apiConfig) writeStreamEvent(w io.Writer, e Event, authorID int) error {
+	if e.Chirp == nil || (authorID != 0 && e.Chirp.Author != authorID) {
+		return nil
+	}
+	var payload interface{}
+	switch e.Type {
+	case eventChirpCreated:
+		resp := []chirpsResponse{newChirpResponse(*e.Chirp)}
+		cfg.decorateChirps(resp, 0)
+		payload = resp[0]
+	case eventChirpDeleted:
+		payload = deletedChirpEvent{
+			ID:     e.Chirp.ID,
+			Author: e.Chirp.Author,
+		}
+	default:
+		return nil
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
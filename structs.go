@@ -1,17 +1,34 @@
 package main
 
+import (
+	"sync/atomic"
+	"time"
+)
+
 type apiConfig struct {
-	fileserverHits int
-	JWTSecret      string
+	fileserverHits atomic.Int64
+	keys           *keyring
 	PolkaKey       string
-	database       *DB
+	// Bearer token for the admin API, which is off when it's empty
+	AdminKey string
+	// Where uploads are stored and the URL they're served under
+	MediaDir string
+	MediaURL string
+	database Store
+	// Overrides liveSessionCheckEvery, tests turn it down
+	liveSessionCheckEvery time.Duration
 }
 
 type jsonBody struct {
 	Body             string `json:"body"`
 	Email            string `json:"email"`
+	Handle           string `json:"handle"`
 	Password         string `json:"password"`
 	ExpiresInSeconds int    `json:"expires_in_seconds"`
+	InReplyTo        int    `json:"in_reply_to"`
+	RechirpOf        int    `json:"rechirp_of"`
+	QuoteOf          int    `json:"quote_of"`
+	MediaIDs         []int  `json:"media_ids"`
 }
 
 type cleanedBody struct {
@@ -23,15 +40,50 @@ type errorResponse struct {
 }
 
 type chirpsResponse struct {
-	Author int    `json:"author_id"`
-	Body   string `json:"body"`
-	ID     int    `json:"id"`
+	Author    int       `json:"author_id"`
+	Body      string    `json:"body"`
+	ID        int       `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	InReplyTo int       `json:"in_reply_to,omitempty"`
+	RootID    int       `json:"root_id,omitempty"`
+	RechirpOf int       `json:"rechirp_of,omitempty"`
+	QuoteOf   int       `json:"quote_of,omitempty"`
+	Hashtags  []string  `json:"hashtags,omitempty"`
+	Mentions  []Mention `json:"mentions,omitempty"`
+	MediaIDs  []int     `json:"media_ids,omitempty"`
+	// Filled in by decorateChirps
+	Media               []mediaResponse `json:"media,omitempty"`
+	Original            *chirpsResponse `json:"original,omitempty"`
+	OriginalUnavailable bool            `json:"original_unavailable,omitempty"`
+	LikeCount           int             `json:"like_count"`
+	Reactions           map[string]int  `json:"reactions"`
+	LikedByMe           bool            `json:"liked_by_me"`
+	MyReaction          string          `json:"my_reaction,omitempty"`
 }
 
+// A user as they see themselves
 type userResponse struct {
-	Email     string `json:"email"`
-	ID        int    `json:"id"`
-	ChirpyRed bool   `json:"is_chirpy_red"`
+	Email       string    `json:"email"`
+	Handle      string    `json:"handle,omitempty"`
+	DisplayName string    `json:"display_name,omitempty"`
+	Bio         string    `json:"bio,omitempty"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	ID          int       `json:"id"`
+	ChirpyRed   bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// A user as everyone else sees them, no email
+type profileResponse struct {
+	ID          int       `json:"id"`
+	Handle      string    `json:"handle,omitempty"`
+	DisplayName string    `json:"display_name,omitempty"`
+	Bio         string    `json:"bio,omitempty"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	ChirpyRed   bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
 }
 
 type userLogin struct {
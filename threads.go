@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultThreadDepth = 10
+	maxThreadDepth     = 50
+)
+
+// One chirp in a conversation with its replies nested under it. Deleted
+// chirps stay in the tree as a bare ID and timestamps so their replies
+// aren't orphaned.
+type threadNode struct {
+	chirpsResponse
+	Deleted    bool         `json:"deleted,omitempty"`
+	ReplyCount int          `json:"reply_count"`
+	Replies    []threadNode `json:"replies,omitempty"`
+}
+
+type threadResponse struct {
+	// Root first, down to the parent of the requested chirp
+	Ancestors  []threadNode `json:"ancestors"`
+	Chirp      threadNode   `json:"chirp"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// Gets the conversation around a chirp: its ancestors and its replies up to
+// ?depth= levels deep. Direct replies are paged with ?limit= and cursors.
+func (cfg *apiConfig) handlerGetThread(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		errorResp(w, http.StatusInternalServerError, "Error getting ID")
+		return
+	}
+	depth := defaultThreadDepth
+	if s := r.URL.Query().Get("depth"); s != "" {
+		depth, err = strconv.Atoi(s)
+		if err != nil || depth < 0 {
+			errorResp(w, http.StatusBadRequest, "Invalid depth")
+			return
+		}
+		if depth > maxThreadDepth {
+			depth = maxThreadDepth
+		}
+	}
+	page, err := parsePageParams(r.URL.Query())
+	if err != nil {
+		errorResp(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	conversation, err := cfg.database.GetConversation(chirpID)
+	if err != nil {
+		errorResp(w, http.StatusNotFound, "Chirp Doesn't Exist")
+		return
+	}
+
+	// Deleted chirps are stubs with nothing to decorate, their likes, media
+	// and quotes stay hidden
+	all := make([]chirpsResponse, 0, len(conversation))
+	var stubs []chirpsResponse
+	for _, chirp := range conversation {
+		if chirp.DeletedAt != nil {
+			stub := newChirpResponse(chirp)
+			stub.Reactions = map[string]int{}
+			stubs = append(stubs, stub)
+			continue
+		}
+		all = append(all, newChirpResponse(chirp))
+	}
+	cfg.decorateChirps(all, cfg.optionalUserID(r))
+	all = append(all, stubs...)
+	responses := map[int]chirpsResponse{}
+	replies := map[int][]chirpsResponse{}
+	for _, chirp := range all {
+		responses[chirp.ID] = chirp
+		if chirp.InReplyTo != 0 {
+			replies[chirp.InReplyTo] = append(replies[chirp.InReplyTo], chirp)
+		}
+	}
+	less := chirpLess("", "asc")
+	for _, list := range replies {
+		sort.Slice(list, func(i, j int) bool {
+			return less(list[i], list[j])
+		})
+	}
+
+	var buildNode func(chirp Chirp, depth int) threadNode
+	buildNode = func(chirp Chirp, depth int) threadNode {
+		node := threadNode{
+			chirpsResponse: responses[chirp.ID],
+			Deleted:        chirp.DeletedAt != nil,
+			ReplyCount:     len(replies[chirp.ID]),
+		}
+		if depth == 0 {
+			return node
+		}
+		for _, reply := range replies[chirp.ID] {
+			node.Replies = append(node.Replies, buildNode(conversation[reply.ID], depth-1))
+		}
+		return node
+	}
+
+	focal := conversation[chirpID]
+	resp := threadResponse{
+		Ancestors: []threadNode{},
+		Chirp:     buildNode(focal, 0),
+	}
+	for parentID := focal.InReplyTo; parentID != 0; {
+		parent, ok := conversation[parentID]
+		if !ok {
+			break
+		}
+		resp.Ancestors = append([]threadNode{buildNode(parent, 0)}, resp.Ancestors...)
+		parentID = parent.InReplyTo
+	}
+
+	if depth > 0 {
+		pageReplies, hasNext, hasPrev := paginateChirps(replies[chirpID], less, page)
+		for _, reply := range pageReplies {
+			resp.Chirp.Replies = append(resp.Chirp.Replies, buildNode(conversation[reply.ID], depth-1))
+		}
+		setPageLinks(w, r, pageReplies, hasNext, hasPrev)
+		if hasNext {
+			resp.NextCursor = encodeCursor(pageReplies[len(pageReplies)-1])
+		}
+	}
+
+	jsonResp(w, http.StatusOK, resp)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// A deleted chirp in a thread keeps its place but shows nothing it had:
+// no author, body, media, likes or quoted chirp
+func TestThreadHidesDeletedChirps(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	alice := api.signUp("alice@example.com")
+	bob := api.signUp("bob@example.com")
+	media, err := api.cfg.database.CreateMedia(Media{OwnerID: bob.ID, ContentType: "image/png", File: "a.png", Thumbnail: "a_thumb.png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, quoted, reply, answer := chirpsResponse{}, chirpsResponse{}, chirpsResponse{}, chirpsResponse{}
+	api.do("POST", "/api/chirps", alice.Token, jsonBody{Body: "root"}, &root)
+	api.do("POST", "/api/chirps", alice.Token, jsonBody{Body: "quoted"}, &quoted)
+	status := api.do("POST", "/api/chirps", bob.Token, jsonBody{Body: "secret", InReplyTo: root.ID, QuoteOf: quoted.ID, MediaIDs: []int{media.ID}}, &reply)
+	if status != http.StatusCreated {
+		t.Fatalf("Creating the reply got %d", status)
+	}
+	api.do("POST", "/api/chirps", alice.Token, jsonBody{Body: "answer", InReplyTo: reply.ID}, &answer)
+	api.do("POST", fmt.Sprintf("/api/chirps/%d/likes", reply.ID), alice.Token, nil, nil)
+	status = api.do("DELETE", fmt.Sprintf("/api/chirps/%d", reply.ID), bob.Token, nil, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("Deleting the reply got %d", status)
+	}
+
+	thread := threadResponse{}
+	status = api.do("GET", fmt.Sprintf("/api/chirps/%d/thread", answer.ID), alice.Token, nil, &thread)
+	if status != http.StatusOK {
+		t.Fatalf("Getting the thread got %d", status)
+	}
+	if len(thread.Ancestors) != 2 {
+		t.Fatalf("Expected 2 ancestors, got %d", len(thread.Ancestors))
+	}
+	stub := thread.Ancestors[1]
+	if !stub.Deleted || stub.ID != reply.ID || stub.InReplyTo != root.ID || stub.CreatedAt.IsZero() {
+		t.Errorf("Expected a stub for the deleted reply, got %+v", stub)
+	}
+	if stub.Author != 0 || stub.Body != "" || stub.QuoteOf != 0 || stub.Original != nil ||
+		len(stub.MediaIDs) != 0 || len(stub.Media) != 0 || stub.LikeCount != 0 || stub.LikedByMe {
+		t.Errorf("Expected nothing of the deleted reply to show, got %+v", stub)
+	}
+
+	// Nor does it anywhere in the thread from the top
+	resp, err := http.Get(fmt.Sprintf("%s/api/chirps/%d/thread", api.server.URL, root.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leak := range []string{"secret", "quoted", "a.png"} {
+		if strings.Contains(string(body), leak) {
+			t.Errorf("Expected %q to be hidden, got %s", leak, body)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// How long a refresh token lasts, each rotation starts the clock again
+const refreshTokenLifetime = 60 * 24 * time.Hour
+
+var (
+	errTokenNotFound = errors.New("Refresh token not recognised, log in again")
+	errTokenRevoked  = errors.New("Refresh token revoked")
+	errTokenReused   = errors.New("Refresh token already used, all tokens from that login have been revoked")
+)
+
+// Every refresh token descends from one login. When a token is swapped for
+// a new one the old one is dead, so seeing it again means two parties have
+// the chain and the whole family gets revoked. A family is also what users
+// see as a session, see sessions.go.
+type TokenFamily struct {
+	ID        string    `json:"id"`
+	UserID    int       `json:"user_id"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	// Bumped on every refresh, along with IP
+	LastUsedAt time.Time  `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// An issued refresh token, ID is its jti claim
+type RefreshToken struct {
+	ID        string    `json:"id"`
+	FamilyID  string    `json:"family_id"`
+	UserID    int       `json:"user_id"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Set once it's been exchanged, it can't be used again after that
+	ReplacedBy string `json:"replaced_by,omitempty"`
+}
+
+func (m *MemoryDB) applyTokens(e walEntry) {
+	switch e.Op {
+	case opRevokeToken:
+		// Logs from before revocations were by ID have the whole token
+		if e.ExpiresAt == nil {
+			m.addLegacyRevocation(e.Token)
+			break
+		}
+		m.chirps.RevokedTokens[e.Token] = *e.ExpiresAt
+	case opCreateTokenFamily:
+		m.chirps.TokenFamilies[e.TokenFamily.ID] = *e.TokenFamily
+		m.chirps.RefreshTokens[e.RefreshToken.ID] = *e.RefreshToken
+	case opRotateRefreshToken:
+		old, ok := m.chirps.RefreshTokens[e.Token]
+		if ok {
+			old.ReplacedBy = e.RefreshToken.ID
+			m.chirps.RefreshTokens[e.Token] = old
+		}
+		m.chirps.RefreshTokens[e.RefreshToken.ID] = *e.RefreshToken
+		if e.TokenFamily != nil {
+			m.chirps.TokenFamilies[e.TokenFamily.ID] = *e.TokenFamily
+		}
+	case opRevokeTokenFamily:
+		family, ok := m.chirps.TokenFamilies[e.Value]
+		if ok && family.RevokedAt == nil {
+			revokedAt := e.Time
+			family.RevokedAt = &revokedAt
+			m.chirps.TokenFamilies[e.Value] = family
+		}
+	case opPruneTokens:
+		m.pruneTokensBefore(e.Time)
+	}
+}
+
+// Drops revocations, refresh tokens and families that have all run out by
+// now. Families go once their last token is gone.
+func (m *MemoryDB) pruneTokensBefore(now time.Time) {
+	for id, expiresAt := range m.chirps.RevokedTokens {
+		if !now.Before(expiresAt) {
+			delete(m.chirps.RevokedTokens, id)
+		}
+	}
+	live := map[string]bool{}
+	for id, token := range m.chirps.RefreshTokens {
+		if !now.Before(token.ExpiresAt) {
+			delete(m.chirps.RefreshTokens, id)
+			continue
+		}
+		live[token.FamilyID] = true
+	}
+	for id := range m.chirps.TokenFamilies {
+		if !live[id] {
+			delete(m.chirps.TokenFamilies, id)
+		}
+	}
+}
+
+// Clears out expired token records, run by the janitor
+func (m *MemoryDB) pruneExpiredTokens() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	now := time.Now().UTC()
+	revoked, tokens := 0, 0
+	for _, expiresAt := range m.chirps.RevokedTokens {
+		if !now.Before(expiresAt) {
+			revoked++
+		}
+	}
+	for _, token := range m.chirps.RefreshTokens {
+		if !now.Before(token.ExpiresAt) {
+			tokens++
+		}
+	}
+	if revoked == 0 && tokens == 0 {
+		return nil
+	}
+	err := m.commit(walEntry{Op: opPruneTokens, Time: now})
+	if err != nil {
+		return err
+	}
+	log.Printf("Pruned %d expired revocations and %d expired refresh tokens", revoked, tokens)
+	return nil
+}
+
+// Converts revocations keyed by the whole token into ones keyed by jti, or
+// by legacyTokenID for tokens from before rotation that don't have one
+func (m *MemoryDB) migrateRevokedTokens() {
+	for key := range m.chirps.RevokedTokens {
+		if strings.Contains(key, ".") {
+			delete(m.chirps.RevokedTokens, key)
+			m.addLegacyRevocation(key)
+		}
+	}
+}
+
+func (m *MemoryDB) addLegacyRevocation(token string) {
+	claims := jwt.RegisteredClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(token, &claims)
+	if err != nil || claims.ExpiresAt == nil {
+		return
+	}
+	id := claims.ID
+	if id == "" {
+		id = legacyTokenID(token)
+	}
+	m.chirps.RevokedTokens[id] = claims.ExpiresAt.Time
+}
+
+// Refresh tokens from before rotation have no jti, so their revocations are
+// keyed by a hash of the whole token
+func legacyTokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "legacy-" + hex.EncodeToString(sum[:])
+}
+
+func newRefreshToken(userID int, familyID string, now time.Time) (RefreshToken, error) {
+	id, err := randomID()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return RefreshToken{
+		ID:        id,
+		FamilyID:  familyID,
+		UserID:    userID,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(refreshTokenLifetime),
+	}, nil
+}
+
+// Starts a new family for a login and returns its first refresh token
+func (m *MemoryDB) StartTokenFamily(userID int, userAgent, ip string) (RefreshToken, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.startTokenFamily(userID, userAgent, ip)
+}
+
+// Callers must hold mux for writing
+func (m *MemoryDB) startTokenFamily(userID int, userAgent, ip string) (RefreshToken, error) {
+	familyID, err := randomID()
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	now := time.Now().UTC()
+	token, err := newRefreshToken(userID, familyID, now)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	family := TokenFamily{
+		ID:         familyID,
+		UserID:     userID,
+		UserAgent:  userAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  token.ExpiresAt,
+	}
+	err = m.commit(walEntry{Op: opCreateTokenFamily, TokenFamily: &family, RefreshToken: &token, Time: now})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return token, nil
+}
+
+// Swaps a refresh token from before rotation, which has no jti, for the
+// first token of a new family. The old token is revoked as it's swapped so
+// it only works once, after that it's treated like any revoked token.
+func (m *MemoryDB) AdoptLegacyRefreshToken(token string, expiresAt time.Time, userID int, userAgent, ip string) (RefreshToken, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	legacyID := legacyTokenID(token)
+	if _, ok := m.chirps.RevokedTokens[legacyID]; ok {
+		return RefreshToken{}, errTokenRevoked
+	}
+	err := m.commit(walEntry{Op: opRevokeToken, Token: legacyID, ExpiresAt: &expiresAt})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return m.startTokenFamily(userID, userAgent, ip)
+}
+
+// Exchanges the refresh token with ID tokenID for a new one in the same
+// family, ip is where the refresh came from. Using a token that was already
+// exchanged revokes the family.
+func (m *MemoryDB) RotateRefreshToken(tokenID, ip string) (RefreshToken, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	old, ok := m.chirps.RefreshTokens[tokenID]
+	if !ok {
+		return RefreshToken{}, errTokenNotFound
+	}
+	family, ok := m.chirps.TokenFamilies[old.FamilyID]
+	if !ok {
+		return RefreshToken{}, errTokenNotFound
+	}
+	if family.RevokedAt != nil {
+		return RefreshToken{}, errTokenRevoked
+	}
+	if old.ReplacedBy != "" {
+		err := m.commit(walEntry{Op: opRevokeTokenFamily, Value: family.ID, UserID: family.UserID})
+		if err != nil {
+			return RefreshToken{}, err
+		}
+		return RefreshToken{}, errTokenReused
+	}
+
+	now := time.Now().UTC()
+	token, err := newRefreshToken(old.UserID, old.FamilyID, now)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	family.IP = ip
+	family.LastUsedAt = now
+	family.ExpiresAt = token.ExpiresAt
+	err = m.commit(walEntry{Op: opRotateRefreshToken, Token: old.ID, RefreshToken: &token, TokenFamily: &family, Time: now})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return token, nil
+}
+
+// Revokes every token descended from the same login as tokenID
+func (m *MemoryDB) RevokeTokenFamily(tokenID string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	token, ok := m.chirps.RefreshTokens[tokenID]
+	if !ok {
+		return errTokenNotFound
+	}
+	family, ok := m.chirps.TokenFamilies[token.FamilyID]
+	if !ok || family.RevokedAt != nil {
+		return nil
+	}
+	return m.commit(walEntry{Op: opRevokeTokenFamily, Value: family.ID, UserID: family.UserID})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type testRefresh struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func (api *testAPI) refresh(refreshToken string) (testRefresh, int) {
+	resp := testRefresh{}
+	status := api.do("POST", "/api/refresh", refreshToken, nil, &resp)
+	return resp, status
+}
+
+// Each refresh hands out a new refresh token, and the new access token
+// belongs to the same session
+func TestRefreshRotates(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	login := api.signUp("a@example.com")
+	first, status := api.refresh(login.RefreshToken)
+	if status != http.StatusOK {
+		t.Fatalf("Refreshing got %d", status)
+	}
+	if first.RefreshToken == "" || first.RefreshToken == login.RefreshToken {
+		t.Error("Expected a new refresh token")
+	}
+	second, status := api.refresh(first.RefreshToken)
+	if status != http.StatusOK {
+		t.Fatalf("Refreshing with the rotated token got %d", status)
+	}
+
+	sessions := []sessionResponse{}
+	status = api.do("GET", "/api/sessions", second.Token, nil, &sessions)
+	if status != http.StatusOK {
+		t.Fatalf("Listing sessions got %d", status)
+	}
+	if len(sessions) != 1 || sessions[0].ID != login.SessionID || !sessions[0].Current {
+		t.Errorf("Expected refreshing to stay in session %s, got %+v", login.SessionID, sessions)
+	}
+}
+
+// Using a refresh token twice means it leaked, so everything from that
+// login stops working but other logins carry on
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	login := api.signUp("a@example.com")
+	other := api.login("a@example.com")
+	rotated, status := api.refresh(login.RefreshToken)
+	if status != http.StatusOK {
+		t.Fatalf("Refreshing got %d", status)
+	}
+
+	_, status = api.refresh(login.RefreshToken)
+	if status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 reusing a refresh token, got %d", status)
+	}
+	_, status = api.refresh(rotated.RefreshToken)
+	if status != http.StatusUnauthorized {
+		t.Errorf("Expected the newest token of the family to be revoked too, got %d", status)
+	}
+	status = api.do("GET", "/api/sessions", rotated.Token, nil, nil)
+	if status != http.StatusUnauthorized {
+		t.Errorf("Expected the family's access token to stop working, got %d", status)
+	}
+
+	_, status = api.refresh(other.RefreshToken)
+	if status != http.StatusOK {
+		t.Errorf("Expected the other login to keep working, got %d", status)
+	}
+}
+
+func TestRevokeRefreshToken(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	login := api.signUp("a@example.com")
+	status := api.do("POST", "/api/revoke", login.RefreshToken, nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("Revoking got %d", status)
+	}
+	_, status = api.refresh(login.RefreshToken)
+	if status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 refreshing a revoked token, got %d", status)
+	}
+	status = api.do("GET", "/api/sessions", login.Token, nil, nil)
+	if status != http.StatusUnauthorized {
+		t.Errorf("Expected logging out to end the session, got %d", status)
+	}
+}
+
+// A family revoked for reuse stays revoked after a restart
+func TestReuseRevocationSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.wal.file.Close()
+	token, err := db.StartTokenFamily(1, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := db.RotateRefreshToken(token.ID, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.RotateRefreshToken(token.ID, "127.0.0.1")
+	if !errors.Is(err, errTokenReused) {
+		t.Fatalf("Expected errTokenReused, got %v", err)
+	}
+
+	reopened, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.wal.file.Close()
+	_, err = reopened.RotateRefreshToken(rotated.ID, "127.0.0.1")
+	if !errors.Is(err, errTokenRevoked) {
+		t.Errorf("Expected errTokenRevoked after a restart, got %v", err)
+	}
+	err = reopened.CheckSession(token.FamilyID)
+	if !errors.Is(err, errSessionRevoked) {
+		t.Errorf("Expected the session to be logged out, got %v", err)
+	}
+}
+
+// A refresh token from before rotation, signed with the env secret and
+// without a jti
+func legacyRefreshToken(t *testing.T, userID int) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    legacyRefreshIssuer,
+		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Hour)),
+		Subject:   fmt.Sprintf("%d", userID),
+	}).SignedString([]byte("test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// Tokens without a jti are swapped once for a new session, after that
+// they're dead like any rotated token
+func TestRefreshAdoptsLegacyToken(t *testing.T) {
+	api := newTestAPI(t, NewMemoryDB())
+	login := api.signUp("a@example.com")
+	legacy := legacyRefreshToken(t, login.ID)
+
+	adopted, status := api.refresh(legacy)
+	if status != http.StatusOK {
+		t.Fatalf("Refreshing with a legacy token got %d", status)
+	}
+	_, status = api.refresh(legacy)
+	if status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 using a legacy token twice, got %d", status)
+	}
+	_, status = api.refresh(adopted.RefreshToken)
+	if status != http.StatusOK {
+		t.Fatalf("Refreshing with the adopted token got %d", status)
+	}
+	sessions := []sessionResponse{}
+	api.do("GET", "/api/sessions", adopted.Token, nil, &sessions)
+	if len(sessions) != 2 {
+		t.Errorf("Expected the legacy token to start its own session, got %+v", sessions)
+	}
+
+	revoked := legacyRefreshToken(t, api.signUp("b@example.com").ID)
+	status = api.do("POST", "/api/revoke", revoked, nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("Revoking a legacy token got %d", status)
+	}
+	_, status = api.refresh(revoked)
+	if status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 refreshing a revoked legacy token, got %d", status)
+	}
+}
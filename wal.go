@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Operations recorded in the write-ahead log
+const (
+	opCreateChirp  = "create_chirp"
+	opEditChirp    = "edit_chirp"
+	opDeleteChirp  = "delete_chirp"
+	opRestoreChirp = "restore_chirp"
+	opPurgeChirp   = "purge_chirp"
+	opCreateUser   = "create_user"
+	opUpdateUser   = "update_user"
+	opRevokeToken  = "revoke_token"
+	opUpgradeUser  = "upgrade_user"
+	opFollow       = "follow"
+	opUnfollow     = "unfollow"
+	opLike         = "like"
+	opUnlike       = "unlike"
+
+	opCreateNotification = "create_notification"
+	opReadNotifications  = "read_notifications"
+	opCreateMedia        = "create_media"
+	opDeleteMedia        = "delete_media"
+	opCreateTokenFamily  = "create_token_family"
+	opRotateRefreshToken = "rotate_refresh_token"
+	opRevokeTokenFamily  = "revoke_token_family"
+	opPruneTokens        = "prune_tokens"
+	opRotateSigningKey   = "rotate_signing_key"
+	opClearKeySecrets    = "clear_key_secrets"
+)
+
+// How many log entries to collect before folding them into the main file
+const walCompactEvery = 500
+
+// One line of the write-ahead log. Entries hold the record as it looks after
+// the change so replaying one twice is harmless. Time is when it was committed.
+type walEntry struct {
+	Op           string        `json:"op"`
+	ID           int           `json:"id,omitempty"`
+	Chirp        *Chirp        `json:"chirp,omitempty"`
+	User         *User         `json:"user,omitempty"`
+	Notification *Notification `json:"notification,omitempty"`
+	Media        *Media        `json:"media,omitempty"`
+	TokenFamily  *TokenFamily  `json:"token_family,omitempty"`
+	RefreshToken *RefreshToken `json:"refresh_token,omitempty"`
+	SigningKey   *SigningKey   `json:"signing_key,omitempty"`
+	Token        string        `json:"token,omitempty"`
+	IDs          []int         `json:"ids,omitempty"`
+	// The user acting and who or what they're acting on, e.g. a follow
+	UserID   int    `json:"user_id,omitempty"`
+	TargetID int    `json:"target_id,omitempty"`
+	Value    string `json:"value,omitempty"`
+	// When whatever the entry is about stops mattering, e.g. a revoked token
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Time      time.Time  `json:"time"`
+}
+
+// Append-only log file, every entry is fsynced before it counts
+type writeAheadLog struct {
+	path    string
+	file    *os.File
+	entries int
+	// End of the last complete entry, a failed append is cut back to here
+	size int64
+}
+
+func openWAL(path string) (*writeAheadLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening WAL, %s", err)
+	}
+	return &writeAheadLog{
+		path: path,
+		file: file,
+	}, nil
+}
+
+func (w *writeAheadLog) append(e walEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("Error marshalling WAL entry, %s", err)
+	}
+	data = append(data, '\n')
+	_, err = w.file.Write(data)
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		// Don't leave half an entry for the next one to be glued onto, and
+		// don't let an entry the caller was told failed come back on replay
+		truncErr := w.file.Truncate(w.size)
+		if truncErr != nil {
+			return fmt.Errorf("Error writing WAL, %s, and couldn't roll it back, %s", err, truncErr)
+		}
+		return fmt.Errorf("Error writing WAL, %s", err)
+	}
+	w.size += int64(len(data))
+	w.entries++
+	return nil
+}
+
+// Feeds every entry in the log to apply, in order. A crash mid-write can
+// only tear the last line, so that's dropped, but an unreadable line with
+// entries after it means the log is corrupt and nothing is applied past it.
+func (w *writeAheadLog) replay(apply func(walEntry)) error {
+	_, err := w.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(w.file)
+	var offset int64
+	replayed := 0
+	for line := 1; ; line++ {
+		data, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return fmt.Errorf("Error reading WAL, %s", readErr)
+		}
+		if len(data) == 0 {
+			break
+		}
+		e := walEntry{}
+		err := json.Unmarshal(data, &e)
+		if err != nil {
+			_, peekErr := reader.Peek(1)
+			if peekErr != io.EOF {
+				return fmt.Errorf("Corrupt WAL entry on line %d, %s", line, err)
+			}
+			log.Printf("Dropping torn WAL entry on line %d, %s", line, err)
+			break
+		}
+		apply(e)
+		replayed++
+		offset += int64(len(data))
+		if data[len(data)-1] != '\n' {
+			// Complete entry that lost its newline, finish it off so the
+			// next append starts a fresh line
+			_, err = w.file.Write([]byte{'\n'})
+			if err != nil {
+				return fmt.Errorf("Error repairing WAL, %s", err)
+			}
+			offset++
+			break
+		}
+	}
+	// Cut off anything torn so appends carry on from the last good entry
+	err = w.file.Truncate(offset)
+	if err != nil {
+		return fmt.Errorf("Error truncating WAL, %s", err)
+	}
+	w.size = offset
+	w.entries = replayed
+	log.Printf("Replayed %d WAL entries", replayed)
+	return nil
+}
+
+// Empties the log once its entries are safe in a snapshot
+func (w *writeAheadLog) truncate() error {
+	err := w.file.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("Error truncating WAL, %s", err)
+	}
+	err = w.file.Sync()
+	if err != nil {
+		return err
+	}
+	w.entries = 0
+	w.size = 0
+	return nil
+}
+
+// Writes to a temp file and renames it over path so readers only ever see
+// the old or the new contents, never half of each
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), perm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+
+	// Make the rename itself durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
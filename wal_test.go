@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestDB(t *testing.T, path string) *DB {
+	t.Helper()
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.wal.file.Close() })
+	return db
+}
+
+func mustCreateChirp(t *testing.T, store Store, authorID int, body string) Chirp {
+	t.Helper()
+	chirp, err := store.CreateChirp(CreateChirpParams{Body: body, AuthorID: authorID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chirp
+}
+
+// Changes that only made it into the log come back after a restart
+func TestWALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path)
+	user, err := db.CreateUser("a@example.com", "hash", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := mustCreateChirp(t, db, user.ID, "first")
+	second := mustCreateChirp(t, db, user.ID, "second")
+	_, err = db.EditChirp(first.ID, user.ID, "first, edited")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.DeleteChirp(second.ID, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.wal.entries == 0 {
+		t.Fatal("Expected the changes to be in the WAL")
+	}
+
+	reopened := openTestDB(t, path)
+	got, err := reopened.GetChirpByID(first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Body != "first, edited" {
+		t.Errorf("Expected the edit to be replayed, got %q", got.Body)
+	}
+	_, err = reopened.GetChirpByID(second.ID)
+	if err == nil {
+		t.Error("Expected the deleted chirp to stay deleted")
+	}
+	if _, err := reopened.GetUserByHandle("alice"); err != nil {
+		t.Errorf("Expected the user to be replayed, %s", err)
+	}
+	next := mustCreateChirp(t, reopened, user.ID, "third")
+	if next.ID <= second.ID {
+		t.Errorf("Expected IDs to carry on after %d, got %d", second.ID, next.ID)
+	}
+}
+
+// A crash can leave half a line at the end, that's dropped and the log
+// carries on cleanly after it
+func TestWALTornLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path)
+	mustCreateChirp(t, db, 1, "kept")
+	appendToFile(t, walPath(path), `{"op":"create_chirp","chirp":{"id":`)
+
+	reopened := openTestDB(t, path)
+	chirps, _ := reopened.GetChirps()
+	if len(chirps) != 1 {
+		t.Fatalf("Expected 1 chirp, got %d", len(chirps))
+	}
+	mustCreateChirp(t, reopened, 1, "after the tear")
+
+	again := openTestDB(t, path)
+	chirps, _ = again.GetChirps()
+	if len(chirps) != 2 {
+		t.Fatalf("Expected 2 chirps after appending past a torn line, got %d", len(chirps))
+	}
+}
+
+// An append after a torn line that was never replayed doesn't get glued on
+func TestWALReplayTruncatesTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	w, err := openWAL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.file.Close()
+	err = w.append(walEntry{Op: opFollow, UserID: 1, TargetID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendToFile(t, path, `{"op":"fol`)
+
+	replayed := 0
+	err = w.replay(func(walEntry) { replayed++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.append(walEntry{Op: opFollow, UserID: 1, TargetID: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed = 0
+	err = w.replay(func(walEntry) { replayed++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 2 {
+		t.Errorf("Expected 2 entries, got %d", replayed)
+	}
+}
+
+// Garbage in the middle of the log isn't skipped over
+func TestWALCorruptMiddleLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := openTestDB(t, path)
+	mustCreateChirp(t, db, 1, "one")
+	appendToFile(t, walPath(path), "not json\n")
+	mustCreateChirp(t, db, 1, "two")
+
+	_, err := NewDB(path)
+	if err == nil {
+		t.Fatal("Expected a corrupt WAL to fail loading")
+	}
+}
+
+func appendToFile(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}